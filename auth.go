@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// cookie holding the login session of the web UI
+	authCookieName = "ytdl_auth"
+
+	// how long a login lasts
+	LoginSessionLifetime = 30 * 24 * time.Hour
+)
+
+// hash compared against when the user doesn't exist, so that unknown users take as long to reject as wrong passwords
+const dummyPasswordHash = "$2a$10$2IZE104eouI5aNQ7yqAH4el7sQcWjHs.BbtdU6ScBV0PqDYvdeuKy"
+
+// AuthConfig is read from the JSON file given by -auth. Any combination of methods can be enabled.
+type AuthConfig struct {
+	// Tokens maps user names to static API tokens, for scripts
+	Tokens map[string]string
+	// Users maps user names to bcrypt password hashes, for logging in to the web UI. See -hashPassword
+	Users map[string]string
+	// TrustedHeader is a request header set by a reverse proxy to the authenticated user name, e.g. 'X-Forwarded-User'
+	TrustedHeader string
+	// TrustedProxies are the networks TrustedHeader is accepted from, default loopback only
+	TrustedProxies []string
+}
+
+// Authenticator identifies the user making a request by one authentication method.
+type Authenticator interface {
+	// Authenticate returns the user name, or false if the request doesn't carry valid credentials for this method.
+	Authenticate(r *http.Request) (user string, ok bool)
+}
+
+// Auth is middleware that requires requests to protected paths to be authenticated by one of its methods.
+type Auth struct {
+	methods []Authenticator
+	logins  *loginAuth
+
+	// path prefixes that require authentication
+	protected []string
+
+	logger *slog.Logger
+}
+
+type userCtxKey struct{}
+
+// userFromContext returns the user authenticated for the request, or empty if authentication is disabled.
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userCtxKey{}).(string)
+	return user
+}
+
+// LoadAuth reads the auth config file and returns the middleware for the methods it enables.
+// Requests to paths under any of the protected prefixes must be authenticated.
+func LoadAuth(filename string, protected []string, logger *slog.Logger) (*Auth, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg AuthConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("auth config '%s': %w", filename, err)
+	}
+
+	a := &Auth{protected: protected, logger: logger}
+	if len(cfg.Tokens) > 0 {
+		a.methods = append(a.methods, tokenAuth(cfg.Tokens))
+	}
+	if len(cfg.Users) > 0 {
+		a.logins = &loginAuth{users: cfg.Users, sessions: make(map[string]loginSession)}
+		a.methods = append(a.methods, a.logins)
+	}
+	if cfg.TrustedHeader != "" {
+		h, err := newHeaderAuth(cfg.TrustedHeader, cfg.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("auth config '%s': %w", filename, err)
+		}
+		a.methods = append(a.methods, h)
+	}
+	if len(a.methods) == 0 {
+		return nil, fmt.Errorf("auth config '%s' enables no authentication method", filename)
+	}
+
+	return a, nil
+}
+
+// Middleware authenticates requests before passing them to next. The user is available from the
+// request context, see [userFromContext]. A nil Auth lets every request through.
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range a.methods {
+			if user, ok := m.Authenticate(r); ok {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userCtxKey{}, user)))
+				return
+			}
+		}
+
+		if a.isProtected(r.URL.Path) {
+			a.logger.Debug("unauthenticated request", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ytdl-web"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isProtected reports whether p is under one of the protected prefixes. The path is cleaned first,
+// the same as the mux and file server do.
+func (a *Auth) isProtected(p string) bool {
+	p = path.Clean("/" + p)
+	for _, prefix := range a.protected {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// HashPassword reads a password from stdin and prints its bcrypt hash, for the Users of [AuthConfig].
+func HashPassword() error {
+	var password string
+	if _, err := fmt.Scanln(&password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+// LoginHandler checks the username and password form fields and starts a login session for the web UI.
+func (a *Auth) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a == nil || a.logins == nil {
+		http.Error(w, "password login is not enabled", http.StatusNotFound)
+		return
+	}
+
+	user := r.PostFormValue("username")
+	token, ok := a.logins.login(user, r.PostFormValue("password"))
+	if !ok {
+		a.logger.Warn("login failed", "remote_addr", r.RemoteAddr, "user", user)
+		http.Redirect(w, r, "login.html?failed=1", http.StatusSeeOther)
+		return
+	}
+	a.logger.Info("user logged in", "remote_addr", r.RemoteAddr, "user", user)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(LoginSessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "./", http.StatusSeeOther)
+}
+
+// LogoutHandler ends the login session of the web UI.
+func (a *Auth) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if a != nil && a.logins != nil {
+		if c, err := r.Cookie(authCookieName); err == nil {
+			a.logins.logout(c.Value)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: authCookieName, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "login.html", http.StatusSeeOther)
+}
+
+// tokenAuth authenticates API clients by a static token, sent as 'Authorization: Bearer <token>'
+// or as a 'token' query parameter for clients that can't set headers, e.g. podcast apps.
+// It maps user names to tokens.
+type tokenAuth map[string]string
+
+func (t tokenAuth) Authenticate(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return "", false
+	}
+	for user, userToken := range t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(userToken)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+type loginSession struct {
+	user    string
+	expires time.Time
+}
+
+// loginAuth authenticates web UI users by the login session cookie set by [Auth.LoginHandler].
+// Sessions are kept in memory, so users have to log in again after a restart.
+type loginAuth struct {
+	// user name to bcrypt password hash
+	users map[string]string
+
+	mu       sync.Mutex
+	sessions map[string]loginSession
+}
+
+func (l *loginAuth) Authenticate(r *http.Request) (string, bool) {
+	c, err := r.Cookie(authCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sessions[c.Value]
+	if !ok || time.Now().After(s.expires) {
+		return "", false
+	}
+	return s.user, true
+}
+
+// login checks the password of user and returns a new session token.
+func (l *loginAuth) login(user, password string) (string, bool) {
+	hash, ok := l.users[user]
+	if !ok {
+		hash = dummyPasswordHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil || !ok {
+		return "", false
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for t, s := range l.sessions {
+		if now.After(s.expires) {
+			delete(l.sessions, t)
+		}
+	}
+	l.sessions[token] = loginSession{user: user, expires: now.Add(LoginSessionLifetime)}
+	return token, true
+}
+
+func (l *loginAuth) logout(token string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, token)
+}
+
+// headerAuth trusts the user name in a header set by an authenticating reverse proxy,
+// for requests coming from the proxy's address.
+type headerAuth struct {
+	header  string
+	proxies []netip.Prefix
+}
+
+func newHeaderAuth(header string, proxies []string) (*headerAuth, error) {
+	if len(proxies) == 0 {
+		proxies = []string{"127.0.0.0/8", "::1/128"}
+	}
+	h := &headerAuth{header: header}
+	for _, p := range proxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %w", err)
+		}
+		h.proxies = append(h.proxies, prefix)
+	}
+	return h, nil
+}
+
+func (h *headerAuth) Authenticate(r *http.Request) (string, bool) {
+	user := r.Header.Get(h.header)
+	if user == "" {
+		return "", false
+	}
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return "", false
+	}
+	for _, p := range h.proxies {
+		if p.Contains(addr.Addr().Unmap()) {
+			return user, true
+		}
+	}
+	return "", false
+}
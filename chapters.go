@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/porjo/ytdl-web/internal/ytworker"
+)
+
+const (
+	// suffix appended to an item's URL for its chapters
+	chaptersSuffix = ".chapters.json"
+
+	chaptersMimeType = "application/json+chapters"
+	chaptersVersion  = "1.2.0"
+)
+
+// podcastChapters is the Podcasting 2.0 JSON chapters format,
+// see https://github.com/Podcastindex-org/podcast-namespace/blob/main/chapters/jsonChapters.md
+type podcastChapters struct {
+	Version  string           `json:"version"`
+	Chapters []podcastChapter `json:"chapters"`
+}
+
+type podcastChapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title"`
+}
+
+// serveChapters serves the chapters of an item in the output path at the item's URL with
+// '.chapters.json' appended. Other requests are passed to next.
+func serveChapters(webRoot, outPath string, index *metadataIndex, next http.Handler) http.Handler {
+	prefix := "/" + strings.Trim(outPath, "/") + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		item, ok := strings.CutSuffix(p, chaptersSuffix)
+		if !ok || r.Method != http.MethodGet || !strings.HasPrefix(p, prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		chapters := index.Chapters(filepath.Join(webRoot, filepath.FromSlash(item)))
+		if len(chapters) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", chaptersMimeType)
+		if err := json.NewEncoder(w).Encode(toPodcastChapters(chapters)); err != nil {
+			slog.Error("chapters write error", "error", err)
+		}
+	})
+}
+
+func toPodcastChapters(chapters []ytworker.Chapter) podcastChapters {
+	pc := podcastChapters{Version: chaptersVersion}
+	for _, c := range chapters {
+		pc.Chapters = append(pc.Chapters, podcastChapter{
+			StartTime: c.StartTime,
+			EndTime:   c.EndTime,
+			Title:     c.Title,
+		})
+	}
+	return pc
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	feedTitle = "ytdl-web"
+
+	itunesNS  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	podcastNS = "https://podcastindex.org/namespace/1.0"
+)
+
+type rss struct {
+	XMLName      xml.Name   `xml:"rss"`
+	Version      string     `xml:"version,attr"`
+	XMLNSItunes  string     `xml:"xmlns:itunes,attr"`
+	XMLNSPodcast string     `xml:"xmlns:podcast,attr"`
+	Channel      rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title          string    `xml:"title"`
+	Link           string    `xml:"link"`
+	Description    string    `xml:"description"`
+	LastBuildDate  string    `xml:"lastBuildDate"`
+	ItunesAuthor   string    `xml:"itunes:author,omitempty"`
+	ItunesExplicit string    `xml:"itunes:explicit"`
+	Items          []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title        string               `xml:"title"`
+	ItunesAuthor string               `xml:"itunes:author"`
+	ItunesImage  *itunesImage         `xml:"itunes:image"`
+	Enclosure    rssEnclosure         `xml:"enclosure"`
+	GUID         rssGUID              `xml:"guid"`
+	PubDate      string               `xml:"pubDate"`
+	Chapters     *podcastChaptersLink `xml:"podcast:chapters"`
+	Transcript   *podcastTranscript   `xml:"podcast:transcript"`
+}
+
+type podcastTranscript struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type podcastChaptersLink struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// FeedHandler serves the download library as an RSS 2.0 podcast feed, newest items first.
+// The feed lists the requesting user's library and the shared library, if enabled.
+// The optional 'artist' query parameter limits the feed to a single artist.
+func FeedHandler(webRoot string, libs *libraries, index *metadataIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dirs := []string{libs.Dir(userFromContext(r.Context()))}
+		if libs.shared {
+			dirs = append(dirs, sharedDir)
+		}
+		var recentURLs []recent
+		for _, dir := range dirs {
+			urls, err := GetRecentURLs(r.Context(), webRoot, libs, dir, index)
+			if err != nil {
+				slog.Error("GetRecentURLS error", "error", err)
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			recentURLs = append(recentURLs, urls...)
+		}
+
+		artist := r.URL.Query().Get("artist")
+		if artist != "" {
+			recentURLs = slices.DeleteFunc(recentURLs, func(rec recent) bool {
+				return rec.Artist != artist
+			})
+		}
+
+		slices.SortFunc(recentURLs, func(a, b recent) int {
+			return b.Timestamp.Compare(a.Timestamp)
+		})
+
+		base := baseURL(r)
+
+		feed := rss{
+			Version:      "2.0",
+			XMLNSItunes:  itunesNS,
+			XMLNSPodcast: podcastNS,
+			Channel: rssChannel{
+				Title:          feedTitle,
+				Link:           base.String(),
+				Description:    "Downloads from " + feedTitle,
+				LastBuildDate:  time.Now().Format(time.RFC1123Z),
+				ItunesExplicit: "false",
+			},
+		}
+		if artist != "" {
+			feed.Channel.Title = fmt.Sprintf("%s: %s", feedTitle, artist)
+			feed.Channel.ItunesAuthor = artist
+		}
+
+		// podcast apps can't log in, pass on the API token the feed was requested with
+		var query string
+		if token := r.URL.Query().Get("token"); token != "" {
+			query = url.Values{"token": {token}}.Encode()
+		}
+
+		for _, rec := range recentURLs {
+			enclosure := base.JoinPath(rec.URL)
+			enclosure.RawQuery = query
+			item := rssItem{
+				Title:        rec.Title,
+				ItunesAuthor: rec.Artist,
+				Enclosure: rssEnclosure{
+					URL:    enclosure.String(),
+					Length: rec.Size,
+					Type:   mimeType(rec.URL),
+				},
+				// the filename doesn't change for the life of the item
+				GUID:    rssGUID{Value: path.Base(rec.URL)},
+				PubDate: rec.Timestamp.Format(time.RFC1123Z),
+			}
+			if rec.Artwork != "" {
+				artwork := base.JoinPath(rec.Artwork)
+				artwork.RawQuery = query
+				item.ItunesImage = &itunesImage{Href: artwork.String()}
+			}
+			if len(rec.Chapters) > 0 {
+				chapters := base.JoinPath(rec.URL + chaptersSuffix)
+				chapters.RawQuery = query
+				item.Chapters = &podcastChaptersLink{URL: chapters.String(), Type: chaptersMimeType}
+			}
+			if rec.Transcript != "" {
+				transcript := base.JoinPath(rec.Transcript)
+				transcript.RawQuery = query
+				item.Transcript = &podcastTranscript{URL: transcript.String(), Type: "text/vtt"}
+			}
+			feed.Channel.Items = append(feed.Channel.Items, item)
+		}
+
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		_, err := w.Write([]byte(xml.Header))
+		if err != nil {
+			slog.Error("feed write error", "error", err)
+			return
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(feed); err != nil {
+			slog.Error("feed write error", "error", err)
+		}
+	}
+}
+
+// baseURL returns the absolute URL of the web root as seen by the client,
+// taking into account a TLS terminating reverse proxy.
+func baseURL(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host, Path: path.Dir(r.URL.Path)}
+}
+
+func mimeType(filename string) string {
+	t := mime.TypeByExtension(filepath.Ext(filename))
+	if t == "" {
+		return "application/octet-stream"
+	}
+	return t
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/porjo/ytdl-web/internal/command"
+	"github.com/porjo/ytdl-web/internal/metrics"
 )
 
 type ffprobeTags struct {
@@ -17,10 +20,16 @@ type ffprobeTags struct {
 
 type ffprobe struct {
 	Streams []struct {
+		CodecType   string `json:"codec_type"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		}
 		Tags ffprobeTags
 	}
 	Format struct {
 		Tags ffprobeTags
+		// Duration in seconds
+		Duration string
 	}
 }
 
@@ -32,20 +41,40 @@ func runFFprobe(ctx context.Context, ffprobeCmd, filename string) (*ffprobe, err
 		"-show_format",
 	}
 	//	fmt.Printf("ffprobe cmd %s, filename %s, args %v\n", ffprobeCmd, filename, args)
+	start := time.Now()
 	out, err := command.RunCommand(ctx, ffprobeCmd, args...)
+	metrics.FFprobeDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.FFprobeFailures.Inc()
 		return nil, fmt.Errorf("error running ffprobe: '%w'", err)
 	}
 
 	ff := &ffprobe{}
 	err = json.Unmarshal(out, ff)
 	if err != nil {
+		metrics.FFprobeFailures.Inc()
 		return nil, err
 	}
 
 	return ff, nil
 }
 
+// hasVideo reports whether the file has a video stream. Embedded cover art doesn't count.
+func hasVideo(ff *ffprobe) bool {
+	for _, s := range ff.Streams {
+		if s.CodecType == "video" && s.Disposition.AttachedPic == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// duration returns the length of the file in seconds, zero if unknown.
+func duration(ff *ffprobe) float64 {
+	d, _ := strconv.ParseFloat(ff.Format.Duration, 64)
+	return d
+}
+
 func titleArtistDescription(ff *ffprobe) (title, artist, description string) {
 	if ff.Format.Tags.Title != "" {
 		title = ff.Format.Tags.Title
@@ -2,6 +2,7 @@
 // SSE vars
 var reconnectFrequencySeconds = 1; // doubles every retry
 var evtSource;
+var lastEventId = '';
 
 var sseHost = window.location.protocol + "//" + window.location.host;
 if(window.location.pathname !== "/") {
@@ -16,6 +17,18 @@ var progLast = null;
 var seekTimer = null;
 
 var trackId = null;
+// the library item in the player, its ID is empty while streaming a download
+var itemId = '';
+var itemTitle = '';
+var itemArtist = '';
+var positionTicks = 0;
+
+// listening positions stored on the server, keyed by item ID
+var positions = {};
+
+// items of the user's library and of the shared library
+var recentOwn = [];
+var recentShared = [];
 
 //var lastPing = new Date();
 
@@ -25,6 +38,64 @@ async function postData (data) {
 			method: "POST",
 			body: JSON.stringify(data)
 		});
+		checkAuth(response);
+		if (response.status == 429) {
+			// over the per-client limits, the message says which
+			$("#spinner").hide();
+			alert(await response.text() + "\nPlease try again in " + response.headers.get("Retry-After") + " seconds.");
+			return;
+		}
+		if (response.status == 403) {
+			// refused by the URL policy
+			$("#spinner").hide();
+			alert(await response.text());
+			return;
+		}
+		if (!response.ok) {
+			throw new Error(`Response status: ${response.status}`);
+		}
+	} catch (error) {
+		console.error(error.message);
+	}
+}
+
+// fetchPositions gets where the user stopped listening to each item, the shared library's
+// items don't carry their position
+async function fetchPositions () {
+	try {
+		const response = await fetch(sseHost + "/positions");
+		checkAuth(response);
+		if (!response.ok) {
+			throw new Error(`Response status: ${response.status}`);
+		}
+		positions = await response.json();
+	} catch (error) {
+		console.error(error.message);
+	}
+}
+
+// putPosition stores where the user stopped listening to the item, so that any device can resume
+function putPosition (id, position) {
+	fetch(sseHost + "/positions/" + encodeURIComponent(id), {
+		method: "PUT",
+		body: JSON.stringify({Position: position.currentTime, Duration: position.duration, PlaybackRate: position.playbackRate}),
+		// still sent when the page is closing
+		keepalive: true
+	}).then(checkAuth).catch((error) => console.error(error.message));
+}
+
+// go to the login page if the server requires authentication
+function checkAuth (response) {
+	if (response.status == 401) {
+		window.location = "login.html";
+	}
+}
+
+async function cancelJob (id) {
+	try {
+		const response = await fetch(sseHost + "/dl/" + id, {
+			method: "DELETE"
+		});
 		if (!response.ok) {
 			throw new Error(`Response status: ${response.status}`);
 		}
@@ -38,7 +109,21 @@ $(function(){
 	setupEventSource();
 
 	// fetch /recent will trigger event to send recent URLs
-	fetch(sseHost + "/recent");
+	fetch(sseHost + "/recent").then(checkAuth);
+
+	// audio output profiles
+	fetch(sseHost + "/profiles")
+		.then(response => response.json())
+		.then(names => names.forEach(function(name) {
+			$("#profile").append($("<option>", { value: name, text: name }));
+		}))
+		.catch(error => console.error(error.message));
+
+	$("#mode").change(function() {
+		$("#profile").prop('disabled', $(this).val() != 'audio');
+		$("#trim-silence").prop('disabled', $(this).val() != 'audio');
+		$("#tempo").prop('disabled', $(this).val() != 'audio');
+	});
 
 	const url = new URL(window.location);
 	const searchParams = new URLSearchParams(url.search);
@@ -59,7 +144,15 @@ $(function(){
 		$("#progress-bar > span").css("width", "0%")
 			.text("0%");
 		let $url = $("#url");
-		postData({ url: $url.val() });
+		let mode = $("#mode").val();
+		let audio = mode == 'audio';
+		let profile = audio ? $("#profile").val() : '';
+		postData({
+			url: $url.val(), playlist: $("#playlist").is(":checked"), mode: mode, profile: profile,
+			normalize: $("#normalize").is(":checked"),
+			trim_silence: audio && $("#trim-silence").is(":checked"),
+			tempo: audio ? parseFloat($("#tempo").val()) : 0
+		});
 		$("#status").prepend("Requesting URL " + url + "\n");
 		$url.val('');
 		//$(this).prop('disabled', true);
@@ -69,7 +162,7 @@ $(function(){
 		$("#url").val('');
 	});
 
-	$("#recent_header #controls").click(function() {
+	$("#recent_header #delete-control").click(function() {
 		let urls = [];
 		$(".recent_url.selected").each(function() {
 			urls.push($(this).find(".stream_play").data("stream_url"));
@@ -83,6 +176,37 @@ $(function(){
 		$("#controls").hide();
 	});
 
+	$("#recent_header #pin-control").click(function() {
+		let urls = [];
+		let $selected = $(".recent_url.selected");
+		$selected.each(function() {
+			urls.push($(this).find(".stream_play").data("stream_url"));
+		});
+		$selected.removeClass("selected");
+
+		if( urls.length > 0 ) {
+			// unpin if everything selected is pinned already, otherwise pin
+			let param = $selected.not(".pinned").length == 0 ? {unpin_urls: urls} : {pin_urls: urls};
+			postData(param);
+		}
+		$("#controls").hide();
+	});
+
+	$("#recent_header #share-control").click(function() {
+		let urls = [];
+		// only items in the user's own library can be published
+		$(".recent_url.selected").not(".shared").each(function() {
+			urls.push($(this).find(".stream_play").data("stream_url"));
+		});
+		$(".recent_url.selected").removeClass("selected");
+
+		if( urls.length > 0 ) {
+			let param = {publish_urls: urls};
+			postData(param);
+		}
+		$("#controls").hide();
+	});
+
 	function updateJob (msg) {
 		let $job = $('#job-' + msg.Value.Id);
 		if ($job.length == 0) {
@@ -97,6 +221,10 @@ $(function(){
 					'<label>Size:</label><span class="filesize"></span>' +
 					'<div class="status"></div>'
 			}).appendTo($job);
+			$('<button>', { class: 'button cancel-button', text: 'Cancel' }).click(function() {
+				$(this).prop('disabled', true);
+				cancelJob(msg.Value.Id);
+			}).appendTo($job);
 		}
 
 		if (!('Title' in msg.Value)) {
@@ -130,6 +258,23 @@ $(function(){
 		return $job
 	}
 
+	function updateGroup (msg) {
+		let $group = $('#group-' + msg.Value.Id);
+		if ($group.length == 0) {
+			$group = $('<div>', { id: 'group-' + msg.Value.Id, class: 'group' }).prependTo('#output');
+			$('<div>', { class: 'group-title' }).appendTo($group);
+			$('<div>', { class: 'progress-bar', html: '<span>0%</span>' }).appendTo($group);
+		}
+
+		let finished = msg.Value.Completed + msg.Value.Failed + msg.Value.Cancelled;
+		$group.find('.group-title').text("Playlist: " + msg.Value.Title + " (" + finished + " / " + msg.Value.Total + ")");
+		let pct = msg.Value.Pct > 100 ? 100 : msg.Value.Pct;
+		$group.find('.progress-bar > span').css("width", pct + "%")
+			.text(pct.toFixed(1) + "%");
+
+		return $group
+	}
+
 	function msgHandler(json) {
 		//console.log("msgHandler", json);
 		let msg = JSON.parse(json);
@@ -141,115 +286,278 @@ $(function(){
 					var $job = updateJob(msg);
 					$job.find('.status').prepend("Error: " + msg.Value.Msg + "\n");
 					break;
+				case 'retry':
+					$("#output").show();
+					$("#spinner").hide();
+					var $job = updateJob(msg);
+					$job.find('.progress-bar > span').css("width", "0%").text("0%");
+					$job.find('.status').prepend("Retry " + msg.Value.Attempt + "/" + msg.Value.MaxAttempts + " in " + msg.Value.Delay + ": " + msg.Value.Msg + "\n");
+					break;
 				case 'unknown':
 					$("#output").show();
 					$("#spinner").hide();
 					var $job = updateJob(msg);
 					$job.find('.status').prepend(msg.Value.Msg);
 					break;
+				case 'queued':
+					$("#output").show();
+					$("#spinner").hide();
+					var $job = updateJob(msg);
+					$job.find('.title').text(msg.Value.Msg);
+					$job.find('.status').prepend("Queued\n");
+					break;
 				case 'completed':
+				case 'cancelled':
 					$("#spinner").hide();
 					var $job = updateJob(msg);
 					$job.remove();
 					break;
+				case 'group':
+					$("#output").show();
+					$("#spinner").hide();
+					updateGroup(msg);
+					break;
+				case 'group_completed':
+					updateGroup(msg).remove();
+					break;
 				case 'info':
 					$("#output").show();
 					$("#spinner").hide();
 					updateJob(msg);
 					break;
 				case 'link_stream':
-					if(!isPlaying()) {
+					if(msg.Value.Video) {
+						if(!isPlaying()) {
+							playVideo(msg.Value.DownloadURL);
+						}
+					} else if(!isPlaying()) {
 						$("#playa").show();
 						updatePlayer(msg.Value.DownloadURL, msg.Value.Title, msg.Value.Artist);
 					}
 					break;
 				case 'recent':
-					if( msg.Value.length == 0 ) {
-						break;
-					}
-					$("#recent").show();
-					$("#recent_urls").empty();
-					for (let i=0; i< msg.Value.length; i++) {
-						let artist = msg.Value[i].Artist;
-						let title = msg.Value[i].Title;
-						// let description = msg.Value[i].Description;
-						// if(description.length == 0) description = "n/a";
-						let $ru = $("<div>", {class: 'recent_url'});
-						let $cont = $("<div>", {class: 'media_meta'});
-						$cont.append($("<span>", {class: 'media_artist', text: artist}));
-						$cont.append($("<span>", { class: 'media_title', text: title }));
-						// let $description = $("<div>", { class: 'media_description', text: description });
-						// $cont.append($description);
-						$ru.click(function() {
-							$(this).closest(".recent_url").toggleClass("selected");
-							if( $(".recent_url.selected").length > 0 ) {
-								$("#controls").show();
-								$("#controls").addClass("fade");
-							} else {
-								$("#controls").removeClass("fade");
-								$("#controls").hide();
-							}
-							// $description.slideToggle().addClass('overflow_scroll');
-						});
-						$ru.append($cont);
-
-						let $media = $("<div>", {class: 'media'});
-						$playButton = $("<svg>", {version: "2.0"}).append( $("<use>", {href: "#play-btn"}) );
-						let $mediaPlay = $("<div>", {class: 'stream_play', html: $playButton});
-						// 'refresh' play button content to allow SVG to display
-						$mediaPlay.html($mediaPlay.html());
-						$mediaPlay.data("stream_url", msg.Value[i].URL);
-						$mediaPlay.data("artist", artist);
-						$mediaPlay.data("title", title);
-						$mediaPlay.click(streamPlayClick);
-						$media.append($mediaPlay);
-						const progress = getMediaProgress(title, artist);
-						if (progress.duration > 0) {
-							const currentTime = new Date(progress.currentTime * 1000).toISOString().slice(11, 19);
-							const duration = new Date(progress.duration * 1000).toISOString().slice(11, 19);
-							let mediaProgressTxt = currentTime + " / " + duration + " - " + progress.percent.toFixed(0).padStart(3) + "%";
-							mediaProgressTxt = mediaProgressTxt.replaceAll(" ", "&nbsp;");
-							let $mediaProgress = $("<div>", { class: 'media_progress', html: mediaProgressTxt });
-							$media.append($mediaProgress);
+					recentOwn = msg.Value;
+					for (const item of recentOwn) {
+						if (item.Position) {
+							positions[item.ID] = item.Position;
 						}
-						$ru.append($media);
-						$("#recent_urls").append($ru);
 					}
+					renderRecent();
+					break;
+				case 'shared':
+					recentShared = msg.Value;
+					$("#share-control").show();
+					fetchPositions().then(renderRecent);
 					break;
 			}
 		}
 	};
 
+	// renderRecent lists the items of the user's library, followed by the shared library
+	function renderRecent() {
+		let items = recentOwn.concat(recentShared);
+		if( items.length == 0 ) {
+			$("#recent").hide();
+			return;
+		}
+		$("#recent").show();
+		$("#recent_urls").empty();
+		for (let i=0; i< items.length; i++) {
+			let artist = items[i].Artist;
+			let title = items[i].Title;
+			// let description = items[i].Description;
+			// if(description.length == 0) description = "n/a";
+			let $ru = $("<div>", {class: 'recent_url'});
+			if (items[i].Shared) {
+				$ru.addClass('shared');
+			}
+			if (items[i].Pinned) {
+				$ru.addClass('pinned');
+			}
+			if (items[i].Artwork) {
+				$ru.append($("<img>", {class: 'media_artwork', src: items[i].Artwork, alt: '', loading: 'lazy'}));
+			}
+			let $cont = $("<div>", {class: 'media_meta'});
+			$cont.append($("<span>", {class: 'media_artist', text: artist}));
+			$cont.append($("<span>", { class: 'media_title', text: title }));
+			let details = [];
+			if (items[i].Video) {
+				details.push('video');
+			}
+			if (items[i].Duration) {
+				details.push(new Date(items[i].Duration * 1000).toISOString().slice(11, 19));
+			}
+			if (items[i].Tempo) {
+				details.push(items[i].Tempo + 'x');
+			}
+			if (items[i].SilenceTrimmed) {
+				details.push('silence trimmed');
+			}
+			if (details.length > 0) {
+				$cont.append($("<span>", { class: 'media_type', text: details.join(' · ') }));
+			}
+			if (items[i].Shared) {
+				let shared = items[i].Owner ? 'shared by ' + items[i].Owner : 'shared';
+				$cont.append($("<span>", { class: 'media_shared', text: shared }));
+			}
+			if (items[i].Pinned) {
+				$cont.append($("<span>", { class: 'media_pinned', text: 'pinned' }));
+			}
+			if (items[i].Transcript) {
+				let $transcript = $("<a>", { class: 'media_transcript', text: 'transcript', href: items[i].URL + '.transcript.txt', target: '_blank' });
+				$transcript.click(function(e) {
+					e.stopPropagation();
+				});
+				$cont.append($transcript);
+			}
+			// let $description = $("<div>", { class: 'media_description', text: description });
+			// $cont.append($description);
+			$ru.click(function() {
+				$(this).closest(".recent_url").toggleClass("selected");
+				if( $(".recent_url.selected").length > 0 ) {
+					$("#controls").show();
+					$("#controls").addClass("fade");
+				} else {
+					$("#controls").removeClass("fade");
+					$("#controls").hide();
+				}
+				// $description.slideToggle().addClass('overflow_scroll');
+			});
+			$ru.append($cont);
+
+			let $media = $("<div>", {class: 'media'});
+			$playButton = $("<svg>", {version: "2.0"}).append( $("<use>", {href: "#play-btn"}) );
+			let $mediaPlay = $("<div>", {class: 'stream_play', html: $playButton});
+			// 'refresh' play button content to allow SVG to display
+			$mediaPlay.html($mediaPlay.html());
+			$mediaPlay.data("stream_url", items[i].URL);
+			$mediaPlay.data("id", items[i].ID);
+			$mediaPlay.data("artist", artist);
+			$mediaPlay.data("title", title);
+			$mediaPlay.data("video", items[i].Video);
+			$mediaPlay.data("chapters", items[i].Chapters || []);
+			$mediaPlay.data("artwork", items[i].Artwork || '');
+			$mediaPlay.data("transcript", items[i].Transcript || '');
+			$mediaPlay.click(streamPlayClick);
+			$media.append($mediaPlay);
+			const progress = getMediaProgress(items[i].ID, title, artist);
+			if (progress.duration > 0) {
+				const currentTime = new Date(progress.currentTime * 1000).toISOString().slice(11, 19);
+				const duration = new Date(progress.duration * 1000).toISOString().slice(11, 19);
+				let mediaProgressTxt = currentTime + " / " + duration + " - " + progress.percent.toFixed(0).padStart(3) + "%";
+				mediaProgressTxt = mediaProgressTxt.replaceAll(" ", "&nbsp;");
+				let $mediaProgress = $("<div>", { class: 'media_progress', html: mediaProgressTxt });
+				$media.append($mediaProgress);
+			}
+			$ru.append($media);
+			$("#recent_urls").append($ru);
+		}
+	}
+
 	function streamPlayClick(e) {
 		e.stopPropagation();
-		$("#playa").show();
 		let url = $(this).data("stream_url");
 		let title = $(this).data("title");
 		let artist = $(this).data("artist");
-		updatePlayer(url, title, artist, true);
+		let chapters = $(this).data("chapters");
+		let artwork = $(this).data("artwork");
+		if ($(this).data("video")) {
+			$("#videoplaya video").attr("poster", artwork);
+			playVideo(url, true, $(this).data("transcript"));
+			renderChapters(chapters, (t) => { $("#videoplaya video")[0].currentTime = t; });
+			return;
+		}
+		$("#playa").show();
+		updatePlayer(url, title, artist, true, artwork, $(this).data("id"));
+		renderChapters(chapters, (t) => { player.seek(t); });
+	}
+
+	// renderChapters lists the chapters of the playing item, clicking one seeks to its start
+	function renderChapters(chapters, seek) {
+		$("#chapters").empty();
+		if (chapters.length == 0) {
+			$("#chapters").hide();
+			return;
+		}
+		for (let i=0; i < chapters.length; i++) {
+			const start = new Date(chapters[i].StartTime * 1000).toISOString().slice(11, 19);
+			let $ch = $("<div>", {class: 'chapter'});
+			$ch.append($("<span>", {class: 'chapter_start', text: start}));
+			$ch.append($("<span>", {class: 'chapter_title', text: chapters[i].Title}));
+			$ch.click(function() {
+				seek(chapters[i].StartTime);
+			});
+			$("#chapters").append($ch);
+		}
+		$("#chapters").show();
 	}
 
 	function isPlaying() {
 		if(player && !player.audio.paused) {
 			return true;
 		}
+		let video = $("#videoplaya video")[0];
+		if(!video.paused) {
+			return true;
+		}
 		return false
 	}
 
-	function getMediaProgress(title, artist) {
-		let trackId = "ytdl-" + title + " - " + artist;
-		let obj = JSON.parse(localStorage.getItem(trackId))
-		if (obj) {
+	function playVideo(url, autoplay=false, subtitles='') {
+		if(player) {
+			player.pause();
+		}
+		let video = $("#videoplaya video")[0];
+		$(video).find("track").remove();
+		if (subtitles) {
+			$(video).append($("<track>", {kind: 'subtitles', src: subtitles, label: 'Transcript', default: true}));
+		}
+		$("#videoplaya").show();
+		video.src = url;
+		if(autoplay) {
+			video.play();
+		}
+	}
+
+	// savedPosition returns the latest of the item's position on the server and in this browser,
+	// which also keeps positions saved before items had IDs under their title and artist
+	function savedPosition(id, title, artist) {
+		let saved = [];
+		if (id && positions[id]) {
+			const p = positions[id];
+			saved.push({currentTime: p.Position, duration: p.Duration, playbackRate: p.PlaybackRate, timestamp: new Date(p.LastPlayed).getTime()});
+		}
+		for (const key of [id ? "ytdl-" + id : null, "ytdl-" + title + " - " + artist]) {
+			let obj = key ? JSON.parse(localStorage.getItem(key)) : null;
+			if (obj) {
+				saved.push(obj);
+			}
+		}
+		saved.sort((a, b) => b.timestamp - a.timestamp);
+		return saved.length > 0 ? saved[0] : null;
+	}
+
+	function getMediaProgress(id, title, artist) {
+		let obj = savedPosition(id, title, artist);
+		if (obj && obj.duration > 0) {
 			return {currentTime: obj.currentTime, duration: obj.duration, percent: (obj.currentTime/obj.duration*100)};
 		} else {
 			return {currentTime: 0, duration: 0, percent: 0};
 		}
 	}
 
-	function updatePlayer(url, title, artist, autoplay=false) {
+	function updatePlayer(url, title, artist, autoplay=false, cover='', id='') {
+
+		$("#videoplaya video")[0].pause();
 
 		trackId =  "ytdl-" + title + " - " + artist;
 		document.title = trackId;
+		itemId = id;
+		itemTitle = title;
+		itemArtist = artist;
+		if (id) {
+			trackId = "ytdl-" + id;
+		}
 
 		if( player === null ) {
 			player = new Shikwasa.Player({
@@ -257,6 +565,7 @@ $(function(){
 				audio: {
 					title: title,
 					artist: artist,
+					cover: cover,
 					src: url
 				},
 				speedOptions: [1.0, 1.1, 1.2],
@@ -264,7 +573,7 @@ $(function(){
 			});
 
 			player.on('loadedmetadata', (e) => {
-				let obj = JSON.parse(localStorage.getItem(trackId))
+				let obj = savedPosition(itemId, itemTitle, itemArtist);
 				if (obj && obj.currentTime > 0) {
 					player.seek(obj.currentTime);
 					if (obj.playbackRate) {
@@ -277,10 +586,23 @@ $(function(){
 					if (isPlaying()) {
 						let o = { currentTime: player.currentTime, duration: player.duration, timestamp: new Date().getTime(), playbackRate: player.playbackRate }
 						localStorage.setItem(trackId, JSON.stringify(o));
+						// the server is updated less often
+						if (itemId && ++positionTicks % 5 == 0) {
+							putPosition(itemId, o);
+						}
 					}
 				}, 2000);
 			});
 
+			player.on('pause', () => {
+				if (itemId && player.duration > 0) {
+					let o = { currentTime: player.currentTime, duration: player.duration, timestamp: new Date().getTime(), playbackRate: player.playbackRate }
+					positions[itemId] = { Position: o.currentTime, Duration: o.duration, PlaybackRate: o.playbackRate, LastPlayed: new Date(o.timestamp).toISOString() };
+					localStorage.setItem(trackId, JSON.stringify(o));
+					putPosition(itemId, o);
+				}
+			});
+
 		} else {
 
 			if (seekTimer !== null) {
@@ -290,6 +612,7 @@ $(function(){
 			player.update({
 				title: title,
 				artist: artist,
+				cover: cover,
 				src: url
 			});
 		}
@@ -350,7 +673,12 @@ $(function(){
 	});
 
 	function setupEventSource () {
-		evtSource = new EventSource(sseHost + "/sse");
+		// resume from the last message received, the server replays anything missed in the meantime
+		let sseURL = sseHost + "/sse";
+		if (lastEventId) {
+			sseURL += "?lastEventId=" + encodeURIComponent(lastEventId);
+		}
+		evtSource = new EventSource(sseURL);
 
 		evtSource.onopen = function (e) {
 			// Reset reconnect frequency upon successful connection
@@ -371,6 +699,9 @@ $(function(){
 		*/
 
 		evtSource.onmessage = function (e) {
+			if (e.lastEventId) {
+				lastEventId = e.lastEventId;
+			}
 			let messages = e.data.split(/\r?\n/);
 			messages.forEach(msgHandler)
 		}
@@ -9,17 +9,21 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/metrics"
 	"github.com/porjo/ytdl-web/internal/ytworker"
 	sse "github.com/tmaxmax/go-sse"
 )
 
 const (
-	// timeout opus stream if no new data read from file in this time
+	// timeout opus stream if no new data read from file in this time, or range request if no data written at the requested offset
 	StreamSourceTimeout = 30 * time.Second
 
 	// FIXME: need a better way of detecting and timing out slow clients
@@ -28,11 +32,88 @@ const (
 
 	// default content expiry in seconds
 	DefaultExpiry = 24 * time.Hour
+
+	// job journal filename, relative to the data directory. It used to be kept in the output
+	// path with a leading dot, see [stateFile].
+	JournalFile = "jobs.json"
+
+	// cached ffprobe results, users' pins and listening positions, relative to the data directory
+	MetadataFile = "metadata.json"
+
+	// maximum time to list the entries of a playlist
+	PlaylistExpandTimeout = 60 * time.Second
+
+	// number of SSE messages kept per topic for reconnecting clients
+	SSEReplaySize = 200
+	// SSE topics without new messages for this long are dropped from the replay buffer
+	SSEReplayExpiry = time.Hour
 )
 
 type Request struct {
 	URL        string
 	DeleteURLs []string `json:"delete_urls"`
+	// PublishURLs are moved from the user's library to the shared library
+	PublishURLs []string `json:"publish_urls"`
+	// PinURLs are kept regardless of expiry and the library quota, until unpinned
+	PinURLs   []string `json:"pin_urls"`
+	UnpinURLs []string `json:"unpin_urls"`
+
+	// Playlist expands a playlist or channel URL into a job per entry
+	Playlist bool
+	// PlaylistItems optionally selects playlist entries using yt-dlp syntax, e.g. '1-10'
+	PlaylistItems string `json:"playlist_items"`
+
+	// Mode is 'audio' (default) or 'video'
+	Mode string
+	// Profile optionally names the audio output profile
+	Profile string
+	// Normalize applies EBU R128 loudness normalization to the output
+	Normalize bool
+	// TrimSilence removes long silences from the output
+	TrimSilence bool `json:"trim_silence"`
+	// Tempo renders the output faster or slower, e.g. 1.5, with the pitch unchanged
+	Tempo float64
+}
+
+// Response is returned by POST /dl for download requests.
+// The IDs can be used to look up the job with GET /jobs/{id}.
+type Response struct {
+	// ID of the job, or of the identical job the request was attached to
+	ID int64 `json:",omitempty"`
+	// Group and IDs are set for playlist requests
+	Group int64   `json:",omitempty"`
+	IDs   []int64 `json:",omitempty"`
+}
+
+// options validates the per-request download settings. The output goes to the library of the user making the request.
+func (dl *dlHandler) options(ctx context.Context, req Request) (jobs.Options, error) {
+	opts := jobs.Options{Mode: req.Mode, Profile: req.Profile, Library: dl.Libraries.Dir(userFromContext(ctx)),
+		Normalize: req.Normalize, TrimSilence: req.TrimSilence}
+	switch req.Mode {
+	case "":
+		opts.Mode = ytworker.ModeAudio
+	case ytworker.ModeAudio, ytworker.ModeVideo:
+	default:
+		return opts, fmt.Errorf("unknown mode '%s'", req.Mode)
+	}
+	if req.Tempo != 0 && req.Tempo != 1 {
+		if req.Tempo < ytworker.MinTempo || req.Tempo > ytworker.MaxTempo {
+			return opts, fmt.Errorf("tempo must be between %g and %g", ytworker.MinTempo, ytworker.MaxTempo)
+		}
+		opts.Tempo = req.Tempo
+	}
+	if (opts.TrimSilence || opts.Tempo > 0) && opts.Mode != ytworker.ModeAudio {
+		return opts, fmt.Errorf("silence trimming and tempo only apply to audio mode")
+	}
+	if req.Profile != "" {
+		if opts.Mode != ytworker.ModeAudio {
+			return opts, fmt.Errorf("profiles only apply to audio mode")
+		}
+		if _, ok := dl.Downloader.Profile(req.Profile); !ok {
+			return opts, fmt.Errorf("unknown profile '%s'", req.Profile)
+		}
+	}
+	return opts, nil
 }
 
 type dlHandler struct {
@@ -41,6 +122,10 @@ type dlHandler struct {
 	FFProbeCmd string
 	Dispatcher *jobs.Dispatcher
 	Downloader *ytworker.Download
+	Journal    *jobs.Journal
+	Index      *metadataIndex
+	Libraries  *libraries
+	Limits     *clientLimits
 
 	Logger *slog.Logger
 
@@ -49,7 +134,8 @@ type dlHandler struct {
 
 func (dl *dlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	logger := dl.Logger.With("dl", r.RemoteAddr)
+	session := sessionID(w, r)
+	logger := dl.Logger.With("dl", r.RemoteAddr, "session", session)
 	logger.Info("client connected")
 
 	decoder := json.NewDecoder(r.Body)
@@ -66,8 +152,20 @@ func (dl *dlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dl.msgHandler(r.Context(), req)
+	resp, err := dl.msgHandler(r.Context(), req, session, clientID(r))
 	if err != nil {
+		var le *limitError
+		if errors.As(err, &le) {
+			logger.Warn("request over client limit", "error", err)
+			w.Header().Set("Retry-After", strconv.Itoa(int(le.retryAfter.Round(time.Second).Seconds())))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, ytworker.ErrURLNotAllowed) {
+			logger.Warn("URL refused by policy", "url", req.URL, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		logger.Error("msgHandler error", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, err = w.Write([]byte(err.Error()))
@@ -77,26 +175,273 @@ func (dl *dlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if resp != nil {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			logger.Error("ServeHTTP response write error", "error", err)
+		}
+	}
+
 	logger.Debug("serveHTTP end")
 }
 
-func (dl *dlHandler) msgHandler(ctx context.Context, req Request) error {
+func (dl *dlHandler) msgHandler(ctx context.Context, req Request, session, client string) (*Response, error) {
 
-	if req.URL == "" && len(req.DeleteURLs) == 0 {
-		return fmt.Errorf("unknown parameters")
+	if req.URL == "" && len(req.DeleteURLs) == 0 && len(req.PublishURLs) == 0 && len(req.PinURLs) == 0 && len(req.UnpinURLs) == 0 {
+		return nil, fmt.Errorf("unknown parameters")
 	}
 
+	user := userFromContext(ctx)
 	if len(req.DeleteURLs) > 0 {
-		err := DeleteFiles(req.DeleteURLs, dl.WebRoot)
+		err := DeleteFiles(req.DeleteURLs, dl.WebRoot, user, dl.Libraries, dl.Index)
+		dl.publishLibraries(ctx, user)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	} else if len(req.PinURLs) > 0 || len(req.UnpinURLs) > 0 {
+		err := PinFiles(req.PinURLs, true, dl.WebRoot, user, dl.Libraries, dl.Index)
+		if err == nil {
+			err = PinFiles(req.UnpinURLs, false, dl.WebRoot, user, dl.Libraries, dl.Index)
+		}
+		dl.publishLibraries(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(req.PublishURLs) > 0 {
+		err := PublishFiles(req.PublishURLs, dl.WebRoot, user, dl.Libraries, dl.Index)
+		dl.publishLibraries(ctx, user)
+		if err != nil {
+			return nil, err
 		}
 	} else if req.URL != "" {
-		job := &jobs.Job{Payload: req.URL}
-		dl.Dispatcher.Enqueue(job)
+		if err := dl.Limits.Allow(client); err != nil {
+			return nil, err
+		}
+		if err := dl.Downloader.CheckURL(ctx, req.URL); err != nil {
+			return nil, err
+		}
+		if req.Playlist {
+			return dl.enqueuePlaylist(ctx, req, session, client)
+		}
+		opts, err := dl.options(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		job := jobs.NewJob(req.URL, session)
+		job.Client = client
+		job.Options = opts
+		id, err := dl.submit(job)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{ID: id}, nil
+	}
+
+	return nil, nil
+}
+
+// publishLibraries sends the updated lists of the user's library and the shared library
+// to their clients, after files were deleted or published.
+func (dl *dlHandler) publishLibraries(ctx context.Context, user string) {
+	dirs := []string{dl.Libraries.Dir(user)}
+	if dl.Libraries.shared {
+		dirs = append(dirs, sharedDir)
+	}
+	for _, dir := range dirs {
+		if err := publishRecent(ctx, dl.SSE, dl.WebRoot, dl.Libraries, dir, dl.Index); err != nil {
+			dl.Logger.Error("publish recent error", "library", dir, "error", err)
+		}
+	}
+}
+
+// submit enqueues job, unless its output is already in the library or an identical
+// job is in flight, in which case the client is given that result instead.
+// It returns the ID under which the client can follow the job, or a [limitError]
+// if the job would have to be queued and the client's queue is full.
+func (dl *dlHandler) submit(job *jobs.Job) (int64, error) {
+	if filename, ff, ok := dl.Index.Find(ytworker.JobKey(job)); ok {
+		dl.Logger.Info("already in library", "url", job.Payload, "file", filename)
+		var info ytworker.Info
+		info.Title, info.Artist, _ = titleArtistDescription(ff)
+		info.Video = hasVideo(ff)
+		info.DownloadURL, _ = filepath.Rel(dl.WebRoot, filename)
+		info.Chapters = dl.Index.Chapters(filename)
+		// the completed message updates the index, keep the item's processing
+		info.Tempo, info.SilenceTrimmed = dl.Index.Processing(filename)
+		// record the job so it can be looked up like any other
+		if err := dl.Journal.Update(job, jobs.StateDone, nil); err != nil {
+			dl.Logger.Error("journal update error", "id", job.ID, "error", err)
+		}
+		dl.Downloader.Existing(job, info)
+		return job.ID, nil
+	}
+
+	if err := dl.Limits.CheckQueue(job.Client, 1); err != nil {
+		return 0, err
+	}
+
+	if primary, attached := dl.Downloader.Claim(job); attached {
+		dl.Logger.Info("attached to job in flight", "url", job.Payload, "id", primary.ID)
+		if err := dl.Journal.Attach(primary.ID, job.Session); err != nil {
+			dl.Logger.Error("journal update error", "id", primary.ID, "error", err)
+		}
+		return primary.ID, nil
+	}
+
+	dl.Dispatcher.Enqueue(job)
+	dl.Downloader.Queued(job)
+	return job.ID, nil
+}
+
+// enqueuePlaylist expands the playlist at req.URL and enqueues a job for each entry, sharing a group ID.
+// The request is rejected if the entries don't all fit in the client's queue.
+func (dl *dlHandler) enqueuePlaylist(ctx context.Context, req Request, session, client string) (*Response, error) {
+	opts, err := dl.options(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, PlaylistExpandTimeout)
+	defer cancel()
+
+	playlist, err := dl.Downloader.ExpandPlaylist(ctx, req.URL, req.PlaylistItems)
+	if err != nil {
+		return nil, err
+	}
+
+	// entries can point anywhere, not only to the playlist's site
+	urls := make([]string, 0, len(playlist.URLs))
+	for _, u := range playlist.URLs {
+		if err := dl.Downloader.CheckURL(ctx, u); err != nil {
+			dl.Logger.Warn("playlist entry refused by policy", "url", u, "error", err)
+			continue
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("%w: none of the playlist entries are allowed", ytworker.ErrURLNotAllowed)
+	}
+
+	if err := dl.Limits.CheckQueue(client, len(urls)); err != nil {
+		return nil, err
+	}
+
+	groupID := jobs.NewID()
+	children := make([]*jobs.Job, 0, len(urls))
+	for _, u := range urls {
+		job := jobs.NewJob(u, session)
+		job.Client = client
+		job.Group = groupID
+		job.Options = opts
+		children = append(children, job)
+	}
+
+	dl.Logger.Info("playlist expanded", "url", req.URL, "group", groupID, "items", len(children))
+
+	// track the group before any child can report progress
+	dl.Downloader.NewGroup(groupID, playlist.Title, children)
+	resp := &Response{Group: groupID, IDs: make([]int64, 0, len(children))}
+	for _, job := range children {
+		id, err := dl.submit(job)
+		if err != nil {
+			// the queue filled up in the meantime, skip the entry so that the group still completes
+			dl.Logger.Warn("playlist entry skipped", "url", job.Payload, "error", err)
+			if err := dl.Journal.Update(job, jobs.StateCancelled, err); err != nil {
+				dl.Logger.Error("journal update error", "id", job.ID, "error", err)
+			}
+			dl.Downloader.Cancelled(job)
+			id = job.ID
+		}
+		resp.IDs = append(resp.IDs, id)
+	}
+
+	return resp, nil
+}
+
+// CancelHandler cancels the queued or running job given by the {id} path value.
+// Only the session that submitted the job may cancel it.
+func (dl *dlHandler) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	session := sessionID(w, r)
+	logger := dl.Logger.With("dl", r.RemoteAddr, "session", session)
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	job, ok := dl.Dispatcher.Job(id)
+	if !ok || job.Session != session {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	queued, ok := dl.Dispatcher.Cancel(id)
+	if !ok {
+		// finished in the meantime
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("job cancelled", "id", id, "queued", queued)
+
+	// running jobs report their own cancellation once the worker has stopped
+	if queued {
+		dl.Downloader.Cancelled(job)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JobsHandler returns the journal records of jobs submitted by the client's session
+// so it can find out what happened to them, e.g. across a server restart.
+func (dl *dlHandler) JobsHandler(w http.ResponseWriter, r *http.Request) {
+	session := sessionID(w, r)
+
+	records := dl.Journal.Records(session)
+	for i := range records {
+		records[i] = records[i].Redacted()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(records)
+	if err != nil {
+		dl.Logger.Error("JobsHandler response write error", "error", err)
+	}
+}
+
+// JobHandler returns the journal record of the job given by the {id} path value: its state, progress,
+// timings, error and, once done, the download URL of the file.
+// Only the session that submitted the job, or whose request was attached to it, may see it.
+func (dl *dlHandler) JobHandler(w http.ResponseWriter, r *http.Request) {
+	session := sessionID(w, r)
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	record, ok := dl.Journal.Record(id)
+	if !ok || !record.VisibleTo(session) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(record.Redacted())
+	if err != nil {
+		dl.Logger.Error("JobHandler response write error", "error", err)
 	}
+}
 
-	return nil
+// ProfilesHandler returns the names of the available audio output profiles.
+func (dl *dlHandler) ProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(dl.Downloader.ProfileNames())
+	if err != nil {
+		dl.Logger.Error("ProfilesHandler response write error", "error", err)
+	}
 }
 
 // ServeStream sends the file data to the client as a stream
@@ -107,27 +452,59 @@ func (dl *dlHandler) msgHandler(ctx context.Context, req Request) error {
 // By copying the raw bytes into ResponseWriter it causes the response to be sent using
 // HTTP chunked encoding so the client will continue to request more data until the server signals the end.
 //
+// Range requests are answered from the data written so far with a 206 response and an unknown
+// complete length, so clients can seek and resume an interrupted stream.
+//
+// Once encoding has finished the worker renames the file into the library. From then on the
+// file is served by http.ServeContent with its full length, from the temporary path or the final one.
+//
 // There are a couple of challenges to overcome:
-//   - how to know when the encoding has finished? The current solution is to wait StreamSourceTimeoutSec and
-//     end the handler if no data is copied in that time. Is that the best approach?
 //   - how to handle clients that delay requesting more data? In this case ResponseWriter blocks the
 //     Copy operation.
 //
 // I think the only solution is to set WriteTimeout on http.Server
-func ServeStream(webRoot string) http.HandlerFunc {
+func ServeStream(webRoot string, dl *ytworker.Download) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.StreamConnections.Inc()
+		defer metrics.StreamConnections.Dec()
+
 		dir := http.Dir(webRoot)
 
 		filename := strings.Replace(path.Clean(r.URL.Path), "stream/", "", 1)
+		diskName := filepath.Join(webRoot, filepath.FromSlash(filename))
 
 		f, err := dir.Open(filename)
 		if err != nil {
+			// encoding finished before this request, serve the file from the library instead
+			if final, ok := dl.CompletedStream(strings.TrimPrefix(filename, "/")); ok && errors.Is(err, fs.ErrNotExist) {
+				serveCompleted(w, r, dir, final)
+				return
+			}
 			msg, code := toHTTPError(err)
 			http.Error(w, msg, code)
 			return
 		}
 		defer f.Close()
 
+		if streamDone(f, diskName) {
+			fi, err := f.Stat()
+			if err != nil {
+				msg, code := toHTTPError(err)
+				http.Error(w, msg, code)
+				return
+			}
+			http.ServeContent(w, r, filename, fi.ModTime(), f)
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Type", mimeType(filename))
+
+		if start, end, ok := parseByteRange(r.Header.Get("Range")); ok {
+			serveStreamRange(w, r, f, diskName, start, end)
+			return
+		}
+
 		lastData := time.Now()
 		for {
 			// io.Copy doesn't return error on EOF
@@ -137,6 +514,14 @@ func ServeStream(webRoot string) http.HandlerFunc {
 				return
 			}
 			if i == 0 {
+				if streamDone(f, diskName) {
+					// send anything written between the last copy and the rename
+					_, err := io.Copy(w, f)
+					if err != nil {
+						slog.Info("servestream copy error", "error", err)
+					}
+					return
+				}
 				if time.Since(lastData) > StreamSourceTimeout {
 					slog.Info("servestream timeout", "timeout", StreamSourceTimeout)
 					return
@@ -149,6 +534,121 @@ func ServeStream(webRoot string) http.HandlerFunc {
 	}
 }
 
+// serveStreamRange responds to a single byte range request for a file that is still being written.
+// Only data written so far is sent. If the range starts beyond that, wait up to StreamSourceTimeout
+// for the encoder to catch up.
+func serveStreamRange(w http.ResponseWriter, r *http.Request, f http.File, diskName string, start, end int64) {
+	var size int64
+	deadline := time.Now().Add(StreamSourceTimeout)
+	for {
+		fi, err := f.Stat()
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		size = fi.Size()
+
+		if streamDone(f, diskName) {
+			// full length is known now, let ServeContent handle the range
+			http.ServeContent(w, r, diskName, fi.ModTime(), f)
+			return
+		}
+		if start < size {
+			break
+		}
+		if time.Now().After(deadline) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "416 Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	length := end - start + 1
+	// complete length is unknown while the file is growing
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, end))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err := io.CopyN(w, f, length); err != nil {
+		slog.Info("servestream range copy error", "error", err)
+	}
+}
+
+// serveCompleted serves the finished library file at name, relative to the web root.
+func serveCompleted(w http.ResponseWriter, r *http.Request, dir http.Dir, name string) {
+	f, err := dir.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// streamDone reports whether the worker has finished writing f.
+// When encoding completes the temporary file is renamed into the library (or removed on error),
+// so name no longer refers to the open file.
+func streamDone(f http.File, name string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	nameFI, err := os.Stat(name)
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(fi, nameFI)
+}
+
+// parseByteRange parses a Range header containing a single range of the form 'bytes=start-' or
+// 'bytes=start-end'. end is -1 if open ended. Suffix and multiple ranges are not supported
+// for growing files and return ok false, in which case the header should be ignored.
+func parseByteRange(h string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	startStr, endStr, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || startStr == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if endStr == "" {
+		return start, -1, true
+	}
+	end, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
 func toHTTPError(err error) (msg string, httpStatus int) {
 	if errors.Is(err, fs.ErrNotExist) {
 		return "404 page not found", http.StatusNotFound
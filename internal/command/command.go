@@ -2,6 +2,7 @@ package command
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -34,6 +35,10 @@ func RunCommandCh(ctx context.Context, command string, flags ...string) (chan st
 	cmd := exec.CommandContext(ctx, command, flags...)
 	// set process group so that children can be killed
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// on context cancellation, kill the whole process group (e.g. ffmpeg spawned by yt-dlp), not just the parent
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
 	outCh := make(chan string, 10)
 	errCh := make(chan error, 10)
 	stdout, err := cmd.StdoutPipe()
@@ -101,3 +106,33 @@ func RunCommandCh(ctx context.Context, command string, flags ...string) (chan st
 
 	return outCh, errCh, nil
 }
+
+// RunCommandProgress runs command, calling progress with each line it writes to stdout, and returns
+// what it wrote to stderr. Unlike [RunCommandCh] no output is dropped. On context cancellation the whole
+// process group is killed.
+func RunCommandProgress(ctx context.Context, progress func(line string), command string, flags ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command, flags...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		progress(scanner.Text())
+	}
+	// drain the rest so the command doesn't block writing to a full pipe
+	_, _ = io.Copy(io.Discard, stdout)
+
+	err = cmd.Wait()
+	return stderr.Bytes(), err
+}
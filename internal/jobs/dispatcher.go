@@ -4,26 +4,50 @@ package jobs
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/metrics"
 )
 
+// ErrCancelled is the cause set on a job's context when it is cancelled via [Dispatcher.Cancel].
+var ErrCancelled = errors.New("job cancelled")
+
 type Worker interface {
-	Work(j *Job) // Work method defines the behavior of processing a job.
+	Work(ctx context.Context, j *Job) error // Work method defines the behavior of processing a job. ctx is cancelled when the job is cancelled.
 }
 
 // Dispatcher represents a job dispatcher.
 type Dispatcher struct {
-	workerPool chan struct{} // Semaphore for limiting concurrent worker goroutines.
-	jobQueue   chan *Job     // Channel for queuing incoming jobs.
-	worker     Worker        // Worker interface for processing jobs.
+	workerPool   chan struct{} // Semaphore for limiting concurrent worker goroutines.
+	worker       Worker        // Worker interface for processing jobs.
+	journal      *Journal      // Optional on-disk record of job states.
+	maxPerClient int           // Maximum running jobs of a single client, zero for no limit.
+
+	mu            sync.Mutex
+	queue         []*Job                            // Jobs waiting for a free worker.
+	running       map[int64]context.CancelCauseFunc // Cancel functions of jobs currently being worked on.
+	jobs          map[int64]*Job                    // All queued and running jobs, by ID.
+	clientRunning map[string]int                    // Number of running jobs, by client.
+	notify        chan struct{}                     // Signals the main loop that a job was enqueued or a client's job finished.
 }
 
 // NewDispatcher creates a new instance of a job dispatcher with the given parameters.
-func NewDispatcher(worker Worker, maxWorkers int) *Dispatcher {
+// maxPerClient limits how many jobs of the same client run at once, further jobs wait in the queue.
+// If journal is not nil, job state changes are recorded in it.
+func NewDispatcher(worker Worker, maxWorkers, maxPerClient int, journal *Journal) *Dispatcher {
 	return &Dispatcher{
-		workerPool: make(chan struct{}, maxWorkers), // Buffered channel acting as a workerPool. Use empty struct to minimize the memory allocation
-		jobQueue:   make(chan *Job),
-		worker:     worker,
+		workerPool:    make(chan struct{}, maxWorkers), // Buffered channel acting as a workerPool. Use empty struct to minimize the memory allocation
+		worker:        worker,
+		journal:       journal,
+		maxPerClient:  maxPerClient,
+		running:       make(map[int64]context.CancelCauseFunc),
+		jobs:          make(map[int64]*Job),
+		clientRunning: make(map[string]int),
+		notify:        make(chan struct{}, 1),
 	}
 }
 
@@ -35,31 +59,168 @@ func (d *Dispatcher) Start(ctx context.Context) {
 
 	// Main loop for processing jobs.
 	for {
+		// Push to the workerPool to control the number of concurrent workers.
 		select {
 		case <-ctx.Done():
 			// Block until all currently processing jobs have finished.
 			wg.Wait()
-			// When the loop exits (due to context cancellation), stop decrements the wait group counter to indicate that the dispatcher has stopped processing jobs
 			return
-		case job := <-d.jobQueue:
-			// Increment the local wait group to track the processing of this job.
-			wg.Add(1)
-			// Push to the workerPool to control the number of concurrent workers.
-			d.workerPool <- struct{}{}
-			// Process the job concurrently.
-			go func(job *Job) {
-				d.worker.Work(job)
-				wg.Done()
-				// After the job finishes, release the slot in the workerPool.
-				<-d.workerPool
-			}(job)
+		case d.workerPool <- struct{}{}:
+		}
+
+		job := d.next(ctx)
+		if job == nil {
+			// Block until all currently processing jobs have finished.
+			wg.Wait()
+			return
+		}
+
+		jobCtx, cancel := context.WithCancelCause(ctx)
+		d.mu.Lock()
+		d.running[job.ID] = cancel
+		d.mu.Unlock()
+		d.record(job, StateRunning, nil)
+		metrics.BusyWorkers.Inc()
+
+		// Increment the local wait group to track the processing of this job.
+		wg.Add(1)
+		// Process the job concurrently.
+		go func(job *Job) {
+			err := d.worker.Work(jobCtx, job)
+			switch {
+			case errors.Is(context.Cause(jobCtx), ErrCancelled):
+				d.record(job, StateCancelled, nil)
+				observe(job, StateCancelled)
+			case ctx.Err() != nil:
+				// shutting down: leave the job as running so that it's resumed on restart
+			case err != nil:
+				d.record(job, StateFailed, err)
+				observe(job, StateFailed)
+			default:
+				d.record(job, StateDone, nil)
+				observe(job, StateDone)
+			}
+			metrics.BusyWorkers.Dec()
+			cancel(nil)
+			d.mu.Lock()
+			delete(d.running, job.ID)
+			delete(d.jobs, job.ID)
+			d.clientRunning[job.Client]--
+			if d.clientRunning[job.Client] <= 0 {
+				delete(d.clientRunning, job.Client)
+			}
+			d.mu.Unlock()
+			// a job of this client may have been waiting for it to finish
+			d.wake()
+			wg.Done()
+			// After the job finishes, release the slot in the workerPool.
+			<-d.workerPool
+		}(job)
+	}
+}
+
+// next blocks until a job is available and removes it from the queue. Jobs of clients that
+// already have the maximum number of jobs running are skipped.
+// It returns nil if ctx is done first.
+func (d *Dispatcher) next(ctx context.Context) *Job {
+	for {
+		d.mu.Lock()
+		i := slices.IndexFunc(d.queue, func(j *Job) bool {
+			return d.maxPerClient <= 0 || d.clientRunning[j.Client] < d.maxPerClient
+		})
+		if i >= 0 {
+			job := d.queue[i]
+			d.queue = slices.Delete(d.queue, i, i+1)
+			d.clientRunning[job.Client]++
+			metrics.QueueDepth.Set(float64(len(d.queue)))
+			d.mu.Unlock()
+			return job
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-d.notify:
 		}
 	}
 }
 
-// Enqueue puts a job into the queue.
-// If the number of enqueued jobs has already reached the maximum size,
-// This will block until space becomes available in the queue to accept a new job.
+// Enqueue puts a job into the queue. The job will be started once a worker is free.
 func (d *Dispatcher) Enqueue(job *Job) {
-	d.jobQueue <- job
+	d.mu.Lock()
+	d.queue = append(d.queue, job)
+	d.jobs[job.ID] = job
+	metrics.QueueDepth.Set(float64(len(d.queue)))
+	d.mu.Unlock()
+	d.record(job, StateQueued, nil)
+	d.wake()
+}
+
+// wake signals the main loop if it's waiting for a job.
+func (d *Dispatcher) wake() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// ClientJobs returns the number of queued and running jobs of client.
+func (d *Dispatcher) ClientJobs(client string) (queued, running int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, j := range d.queue {
+		if j.Client == client {
+			queued++
+		}
+	}
+	return queued, d.clientRunning[client]
+}
+
+// Job returns the queued or running job with the given ID.
+func (d *Dispatcher) Job(id int64) (*Job, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, ok := d.jobs[id]
+	return job, ok
+}
+
+// Cancel stops the job with the given ID. A queued job is removed from the queue and
+// queued is returned true. A running job has its context cancelled with [ErrCancelled].
+// ok is false if no such job is queued or running.
+func (d *Dispatcher) Cancel(id int64) (queued bool, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cancel, ok := d.running[id]; ok {
+		cancel(ErrCancelled)
+		return false, true
+	}
+
+	i := slices.IndexFunc(d.queue, func(j *Job) bool { return j.ID == id })
+	if i < 0 {
+		return false, false
+	}
+	job := d.queue[i]
+	d.queue = slices.Delete(d.queue, i, i+1)
+	delete(d.jobs, id)
+	metrics.QueueDepth.Set(float64(len(d.queue)))
+	d.record(job, StateCancelled, nil)
+	observe(job, StateCancelled)
+	return true, true
+}
+
+// record writes the job state to the journal, if there is one.
+func (d *Dispatcher) record(job *Job, state State, jobErr error) {
+	if err := d.journal.Update(job, state, jobErr); err != nil {
+		slog.Error("job journal update error", "id", job.ID, "state", state, "error", err)
+	}
+}
+
+// observe counts the outcome of job and how long it took since it was submitted.
+func observe(job *Job, state State) {
+	metrics.Downloads.WithLabelValues(string(state)).Inc()
+	if !job.Created.IsZero() {
+		metrics.DownloadDuration.WithLabelValues(string(state)).Observe(time.Since(job.Created).Seconds())
+	}
 }
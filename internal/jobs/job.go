@@ -1,6 +1,72 @@
 package jobs
 
+import (
+	"sync/atomic"
+	"time"
+)
+
+var lastID atomic.Int64
+
 // Job represents an interface of a job that can be enqueued into a dispatcher.
 type Job struct {
+	ID      int64
 	Payload string
+	// Session identifies the client that submitted the job
+	Session string
+	// Client is the user or remote address the job counts against for per-client limits
+	Client string
+	// Group is the ID shared by jobs expanded from the same playlist, zero otherwise
+	Group int64
+	// Options are the per-request download settings
+	Options Options
+	// Created is when the job was submitted
+	Created time.Time
+}
+
+// Options holds per-request settings that are passed through to the worker.
+type Options struct {
+	// Mode is 'audio' (default) or 'video'
+	Mode string `json:",omitempty"`
+	// Profile names the audio output profile, empty for the default behaviour
+	Profile string `json:",omitempty"`
+	// Library is the directory the output is stored in, relative to the output path
+	Library string `json:",omitempty"`
+	// Normalize applies loudness normalization to the output
+	Normalize bool `json:",omitempty"`
+	// TrimSilence removes long silences from the output
+	TrimSilence bool `json:",omitempty"`
+	// Tempo renders the output faster or slower with the pitch unchanged, zero for the original tempo
+	Tempo float64 `json:",omitempty"`
+}
+
+// NewJob returns a job for the given payload, submitted by session.
+func NewJob(payload, session string) *Job {
+	return &Job{
+		ID:      NewID(),
+		Payload: payload,
+		Session: session,
+		Created: time.Now(),
+	}
+}
+
+// NewID returns a unique ID based on the current time in microseconds.
+// IDs generated in the same microsecond are incremented so they never collide.
+func NewID() int64 {
+	for {
+		last := lastID.Load()
+		id := max(time.Now().UnixMicro(), last+1)
+		if lastID.CompareAndSwap(last, id) {
+			return id
+		}
+	}
+}
+
+// reserveID ensures IDs returned by [NewID] are greater than id.
+func reserveID(id int64) {
+	for {
+		last := lastID.Load()
+		if last >= id || lastID.CompareAndSwap(last, id) {
+			return
+		}
+	}
 }
@@ -0,0 +1,333 @@
+package jobs
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/util"
+)
+
+// how long finished jobs are kept in the journal
+const journalRetention = 24 * time.Hour
+
+type State string
+
+const (
+	StateQueued  State = "queued"
+	StateRunning State = "running"
+	// the download has finished and yt-dlp is converting, merging or tagging the file
+	StatePostProcessing State = "post-processing"
+	StateDone           State = "done"
+	StateFailed         State = "failed"
+	StateCancelled      State = "cancelled"
+)
+
+// Finished reports whether the job has reached a terminal state.
+func (s State) Finished() bool {
+	return s == StateDone || s == StateFailed || s == StateCancelled
+}
+
+// Record is the journal entry for a single job.
+type Record struct {
+	ID      int64
+	URL     string
+	Session string  `json:",omitempty"`
+	Client  string  `json:",omitempty"`
+	Group   int64   `json:",omitempty"`
+	Options Options `json:",omitzero"`
+	State   State
+	Error   string `json:",omitempty"`
+	// Attempt is the number of the current download attempt, when the job has been retried
+	Attempt int `json:",omitempty"`
+
+	Title string `json:",omitempty"`
+	// Progress is the download progress in percent
+	Progress float32 `json:",omitempty"`
+	ETA      string  `json:",omitempty"`
+	// DownloadURL is the path of the finished file, relative to the web root
+	DownloadURL string `json:",omitempty"`
+
+	// Watchers are the sessions whose identical requests were attached to the job
+	Watchers []string `json:",omitempty"`
+
+	Created  time.Time
+	Started  time.Time `json:",omitzero"`
+	Finished time.Time `json:",omitzero"`
+	Updated  time.Time
+}
+
+// VisibleTo reports whether session submitted the job or is attached to it.
+func (r *Record) VisibleTo(session string) bool {
+	return r.Session == session || slices.Contains(r.Watchers, session)
+}
+
+// Journal persists the state of jobs to disk so that unfinished jobs can be resumed after a restart.
+//
+// The whole journal is rewritten on every change. The number of jobs is small, so this keeps the
+// file format simple and the file always consistent.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	records map[int64]*Record
+}
+
+// OpenJournal loads the journal at path, creating it if it doesn't exist.
+func OpenJournal(path string) (*Journal, error) {
+	jl := &Journal{
+		path:    path,
+		records: make(map[int64]*Record),
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return jl, nil
+		}
+		return nil, err
+	}
+
+	var records []*Record
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		jl.records[r.ID] = r
+		// new IDs must not collide with journalled ones, even if the clock went backwards
+		reserveID(r.ID)
+	}
+
+	return jl, nil
+}
+
+// Unfinished returns the jobs that were queued or running when the journal was last written, oldest first.
+func (jl *Journal) Unfinished() []*Job {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	var jobs []*Job
+	for _, r := range jl.sorted() {
+		if !r.State.Finished() {
+			jobs = append(jobs, &Job{ID: r.ID, Payload: r.URL, Session: r.Session, Client: r.Client, Group: r.Group, Options: r.Options, Created: r.Created})
+		}
+	}
+	return jobs
+}
+
+// Records returns the journal entries visible to session, oldest first.
+func (jl *Journal) Records(session string) []Record {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	records := make([]Record, 0)
+	for _, r := range jl.sorted() {
+		if r.VisibleTo(session) {
+			records = append(records, r.clone())
+		}
+	}
+	return records
+}
+
+// Record returns the journal entry for the job id.
+func (jl *Journal) Record(id int64) (Record, bool) {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	r, ok := jl.records[id]
+	if !ok {
+		return Record{}, false
+	}
+	return r.clone(), true
+}
+
+// Update sets the state of job and writes the journal to disk.
+// A nil Journal does nothing.
+func (jl *Journal) Update(job *Job, state State, jobErr error) error {
+	if jl == nil {
+		return nil
+	}
+
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	now := time.Now()
+	r, ok := jl.records[job.ID]
+	if !ok {
+		r = &Record{
+			ID:      job.ID,
+			URL:     job.Payload,
+			Session: job.Session,
+			Client:  job.Client,
+			Group:   job.Group,
+			Options: job.Options,
+			Created: job.Created,
+		}
+		if r.Created.IsZero() {
+			r.Created = now
+		}
+		jl.records[job.ID] = r
+	}
+	r.State = state
+	r.Updated = now
+	r.Error = ""
+	if jobErr != nil {
+		r.Error = jobErr.Error()
+	}
+	switch state {
+	case StateQueued:
+		r.Progress, r.ETA = 0, ""
+		r.Started, r.Finished = time.Time{}, time.Time{}
+	case StateRunning:
+		r.Progress, r.ETA = 0, ""
+		r.Started = now
+	case StateDone, StateFailed, StateCancelled:
+		r.ETA = ""
+		r.Finished = now
+		if state == StateDone {
+			r.Progress = 100
+		}
+	}
+
+	// drop old finished jobs
+	for id, r := range jl.records {
+		if r.State.Finished() && now.Sub(r.Updated) > journalRetention {
+			delete(jl.records, id)
+		}
+	}
+
+	return jl.write()
+}
+
+// Progress records the title and download progress of the running job id.
+// Progress changes too often to be worth writing to disk, it is persisted with the next state change.
+// A nil Journal does nothing.
+func (jl *Journal) Progress(id int64, title string, pct float32, eta string) {
+	if jl == nil {
+		return
+	}
+
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	r, ok := jl.records[id]
+	if !ok || r.State.Finished() {
+		return
+	}
+	if title != "" {
+		r.Title = title
+	}
+	r.Progress = min(pct, 100)
+	r.ETA = eta
+}
+
+// PostProcessing moves the running job id to the post-processing state and writes the journal to disk.
+// A nil Journal does nothing.
+func (jl *Journal) PostProcessing(id int64) error {
+	return jl.modify(id, func(r *Record) bool {
+		if r.State != StateRunning {
+			// finished before the message was handled
+			return false
+		}
+		r.State = StatePostProcessing
+		r.ETA = ""
+		return true
+	})
+}
+
+// Retry records that the running job id failed with errMsg and will be attempted again,
+// and writes the journal to disk. A nil Journal does nothing.
+func (jl *Journal) Retry(id int64, attempt int, errMsg string) error {
+	return jl.modify(id, func(r *Record) bool {
+		if r.State.Finished() {
+			return false
+		}
+		r.Attempt = attempt
+		r.Error = errMsg
+		r.Progress, r.ETA = 0, ""
+		return true
+	})
+}
+
+// Result records the title and download URL of the finished file of job id and writes the journal to disk.
+// A nil Journal does nothing.
+func (jl *Journal) Result(id int64, title, downloadURL string) error {
+	return jl.modify(id, func(r *Record) bool {
+		if title != "" {
+			r.Title = title
+		}
+		r.DownloadURL = downloadURL
+		return true
+	})
+}
+
+// Attach gives session access to the record of job id, for requests that were attached to
+// an identical job instead of being downloaded again. A nil Journal does nothing.
+func (jl *Journal) Attach(id int64, session string) error {
+	return jl.modify(id, func(r *Record) bool {
+		if r.VisibleTo(session) {
+			return false
+		}
+		r.Watchers = append(r.Watchers, session)
+		return true
+	})
+}
+
+// modify calls fn on the record of job id and writes the journal if fn reports a change.
+func (jl *Journal) modify(id int64, fn func(r *Record) bool) error {
+	if jl == nil {
+		return nil
+	}
+
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	r, ok := jl.records[id]
+	if !ok || !fn(r) {
+		return nil
+	}
+	r.Updated = time.Now()
+	return jl.write()
+}
+
+// Redacted returns r without the session IDs, which grant access to other clients' jobs,
+// and the client address.
+func (r Record) Redacted() Record {
+	r.Session = ""
+	r.Client = ""
+	r.Watchers = nil
+	return r
+}
+
+// clone returns a copy of r that doesn't share its slices.
+func (r *Record) clone() Record {
+	c := *r
+	c.Watchers = slices.Clone(r.Watchers)
+	return c
+}
+
+// write replaces the journal file. Must be called with mu held.
+func (jl *Journal) write() error {
+	raw, err := json.Marshal(jl.sorted())
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(jl.path, raw)
+}
+
+// sorted returns the records ordered by ID, which is also submission order. Must be called with mu held.
+func (jl *Journal) sorted() []*Record {
+	records := make([]*Record, 0, len(jl.records))
+	for _, r := range jl.records {
+		records = append(records, r)
+	}
+	slices.SortFunc(records, func(a, b *Record) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return records
+}
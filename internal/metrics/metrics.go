@@ -0,0 +1,102 @@
+// Package metrics defines the Prometheus metrics exported on /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "ytdl"
+
+var (
+	// Downloads counts finished downloads by outcome: done, failed or cancelled
+	Downloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Downloads by outcome.",
+	}, []string{"outcome"})
+
+	// DownloadDuration is the time from submitting a job to its outcome
+	DownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_duration_seconds",
+		Help:      "Time from submitting a download to its outcome, by outcome.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"outcome"})
+
+	DownloadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes downloaded by yt-dlp.",
+	})
+
+	// TranscodedBytes counts the output of files that were re-encoded, rather than remuxed
+	TranscodedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transcoded_bytes_total",
+		Help:      "Bytes written by re-encoding audio.",
+	})
+
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Jobs waiting for a free worker.",
+	})
+
+	BusyWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "busy_workers",
+		Help:      "Workers running a job.",
+	})
+
+	// RejectedRequests counts download requests over a per-client limit, by limit: rate or queue
+	RejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_requests_total",
+		Help:      "Download requests rejected by per-client limits, by limit.",
+	}, []string{"limit"})
+
+	FFprobeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ffprobe_duration_seconds",
+		Help:      "Time taken to run ffprobe.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	FFprobeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ffprobe_failures_total",
+		Help:      "ffprobe runs that failed.",
+	})
+
+	SSESessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sse_sessions",
+		Help:      "Connected server-sent event sessions.",
+	})
+
+	StreamConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_connections",
+		Help:      "Open connections to the stream handler.",
+	})
+
+	CleanupRemovedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanup_removed_files_total",
+		Help:      "Expired files removed by the cleanup routine.",
+	})
+
+	QuotaEvictedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quota_evicted_files_total",
+		Help:      "Files evicted to keep the library within its quota.",
+	})
+
+	// LibraryBytes is updated by the cleanup routine
+	LibraryBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "library_bytes",
+		Help:      "Size of the download library on disk.",
+	})
+)
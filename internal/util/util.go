@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"runtime"
 )
 
@@ -30,6 +32,10 @@ func NonblockingChSendCtx[T any](ctx context.Context, ch chan T, msg T) {
 type Msg struct {
 	Key   string
 	Value interface{}
+
+	// Topics are the SSE topics the message should be published to.
+	// Empty means broadcast to all clients.
+	Topics []string `json:"-"`
 }
 
 func (m Msg) JSON() ([]byte, error) {
@@ -39,3 +45,27 @@ func (m Msg) JSON() ([]byte, error) {
 	}
 	return b, nil
 }
+
+// WriteFileAtomic replaces the file at path with data. The data is written to a temporary file
+// in the same directory which is then renamed, so a crash never leaves a partially written file.
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,50 @@
+package ytworker
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// ArtworkExt is the extension of cover art, which is always converted to JPEG
+	ArtworkExt = ".jpg"
+
+	// largest width and height of cover art in pixels, podcast apps ask for up to 3000
+	// but YouTube thumbnails are at most 1280 wide
+	artworkMaxSize = 1400
+)
+
+// artworkArgs returns the yt-dlp arguments that fetch the thumbnail as a square JPEG of at most
+// artworkMaxSize pixels, cropped from the centre, and embed it as cover art if embed is set.
+func artworkArgs(embed bool) []string {
+	args := []string{
+		"--write-thumbnail",
+		"--convert-thumbnails", "jpg",
+		// yt-dlp splits these like a shell would, the double quotes keep the escaped commas for ffmpeg
+		"--postprocessor-args", fmt.Sprintf(`ThumbnailsConvertor+ffmpeg_o:-vf "crop=min(iw\,ih):min(iw\,ih),scale=min(iw\,%d):-2" -q:v 3`,
+			artworkMaxSize),
+	}
+	if embed {
+		args = append(args, "--embed-thumbnail")
+	}
+	return args
+}
+
+// ArtworkFile returns the path of the cover art of the library item at filename. It is a hidden
+// file next to the item, so it isn't listed as an item itself.
+func ArtworkFile(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+ArtworkExt)
+}
+
+// moveArtwork moves the thumbnail written alongside the temporary file to the item at filename.
+// Sources without a thumbnail are not an error.
+func moveArtwork(tmpFileName, filename string) error {
+	err := os.Rename(tmpFileName+ArtworkExt, ArtworkFile(filename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
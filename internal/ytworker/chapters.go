@@ -0,0 +1,129 @@
+package ytworker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// chapters shorter than this after removing SponsorBlock segments are dropped
+const minChapterSeconds = 1
+
+// Chapter is a titled section of an item, in seconds from the start of the output file.
+type Chapter struct {
+	StartTime float64
+	EndTime   float64
+	Title     string
+}
+
+type ytChapter struct {
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	Title     string  `json:"title"`
+}
+
+// sponsorSegment is a SponsorBlock segment from the info file. Segments of type 'skip' are
+// removed from the output, 'poi' segments only mark a point of interest.
+type sponsorSegment struct {
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	Category  string  `json:"category"`
+	Type      string  `json:"type"`
+}
+
+// skipSegments returns the segments that are removed from the output.
+func skipSegments(segments []sponsorSegment) []sponsorSegment {
+	var skips []sponsorSegment
+	for _, s := range segments {
+		if s.Type == "" || s.Type == "skip" {
+			skips = append(skips, s)
+		}
+	}
+	return skips
+}
+
+// removedSeconds returns how much shorter the output is than the source.
+func removedSeconds(segments []sponsorSegment) float64 {
+	var removed float64
+	for _, s := range skipSegments(segments) {
+		removed += s.EndTime - s.StartTime
+	}
+	return removed
+}
+
+// outputChapters returns the chapters of the source with their timings in the output file,
+// which is shorter than the source by the removed segments.
+func outputChapters(chapters []ytChapter, removed []sponsorSegment) []Chapter {
+	source := make([]Chapter, 0, len(chapters))
+	for _, c := range chapters {
+		source = append(source, Chapter{StartTime: c.StartTime, EndTime: c.EndTime, Title: c.Title})
+	}
+	return removeSegments(source, removed)
+}
+
+// processedChapters returns chapters with their timings after post-processing removed silences
+// and rendered the file at tempo, zero for unchanged.
+func processedChapters(chapters []Chapter, silences []sponsorSegment, tempo float64) []Chapter {
+	chapters = removeSegments(chapters, silences)
+	if tempo <= 0 {
+		return chapters
+	}
+	for i := range chapters {
+		chapters[i].StartTime /= tempo
+		chapters[i].EndTime /= tempo
+	}
+	return chapters
+}
+
+// processedTime returns time t of a file after post-processing removed silences and rendered it at tempo,
+// zero for unchanged.
+func processedTime(t float64, silences []sponsorSegment, tempo float64) float64 {
+	t = shiftTime(t, skipSegments(silences))
+	if tempo > 0 {
+		t /= tempo
+	}
+	return t
+}
+
+// shiftTime moves time t earlier by the length of the skipped segments before it.
+func shiftTime(t float64, skips []sponsorSegment) float64 {
+	out := t
+	for _, s := range skips {
+		out -= max(0, min(t, s.EndTime)-s.StartTime)
+	}
+	return out
+}
+
+// removeSegments moves chapters earlier by the removed segments before them, and drops those
+// that are left shorter than minChapterSeconds.
+func removeSegments(chapters []Chapter, removed []sponsorSegment) []Chapter {
+	skips := skipSegments(removed)
+
+	out := make([]Chapter, 0, len(chapters))
+	for _, c := range chapters {
+		ch := Chapter{StartTime: shiftTime(c.StartTime, skips), EndTime: shiftTime(c.EndTime, skips), Title: c.Title}
+		if ch.EndTime-ch.StartTime < minChapterSeconds {
+			// removed entirely, e.g. a chapter that was itself a sponsor segment
+			continue
+		}
+		out = append(out, ch)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// characters escaped in ffmetadata values
+var ffmetadataEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n")
+
+// ffmetadataChapters returns chapters in ffmpeg's metadata file format, for writing them to a file.
+func ffmetadataChapters(chapters []Chapter) []byte {
+	var b bytes.Buffer
+	b.WriteString(";FFMETADATA1\n")
+	for _, c := range chapters {
+		fmt.Fprintf(&b, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(c.StartTime*1000), int64(c.EndTime*1000), ffmetadataEscaper.Replace(c.Title))
+	}
+	return b.Bytes()
+}
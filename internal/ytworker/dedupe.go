@@ -0,0 +1,143 @@
+package ytworker
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/util"
+)
+
+// query parameters that don't change the media a URL points to
+var trackingParams = []string{"si", "feature", "fbclid", "gclid"}
+
+// inflight is a queued or running job along with the jobs for identical requests
+// that were attached to it instead of being downloaded again.
+type inflight struct {
+	primary  *jobs.Job
+	attached []*jobs.Job
+}
+
+// NormalizeURL returns a canonical form of rawURL so that trivially different URLs for the same media
+// are recognised as duplicates. Scheme and host are lower-cased, the fragment and tracking query
+// parameters are removed and the remaining query parameters are sorted.
+func NormalizeURL(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	q := u.Query()
+	for k := range q {
+		if strings.HasPrefix(k, "utm_") || slices.Contains(trackingParams, k) {
+			q.Del(k)
+		}
+	}
+	// Encode sorts by key
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// JobKey identifies the output of a job: its normalized URL, output settings and library.
+// Jobs with the same key produce the same file.
+func JobKey(j *jobs.Job) string {
+	mode := j.Options.Mode
+	if mode == "" {
+		mode = ModeAudio
+	}
+	key := NormalizeURL(j.Payload) + "\n" + mode + "\n" + j.Options.Profile
+	if j.Options.Library != "" {
+		key += "\n" + j.Options.Library
+	}
+	if j.Options.Normalize {
+		key += "\nnormalize"
+	}
+	if j.Options.TrimSilence {
+		key += "\ntrim"
+	}
+	if j.Options.Tempo > 0 {
+		key += fmt.Sprintf("\ntempo=%g", j.Options.Tempo)
+	}
+	return key
+}
+
+// Claim registers j as the job producing its output. If an identical job is already queued or running,
+// j is attached to it instead: j's session receives that job's messages from now on, and the existing
+// job is returned with attached true. The caller should not enqueue j in that case.
+func (yt *Download) Claim(j *jobs.Job) (primary *jobs.Job, attached bool) {
+	key := JobKey(j)
+
+	yt.Lock()
+	f, ok := yt.inflight[key]
+	if !ok {
+		yt.inflight[key] = &inflight{primary: j}
+		yt.Unlock()
+		return j, false
+	}
+	f.attached = append(f.attached, j)
+	primary = f.primary
+	yt.Unlock()
+
+	// let the new session know about the job it was attached to
+	m := util.Msg{
+		Key: KeyQueued,
+		Value: Misc{
+			Id:  primary.ID,
+			Msg: primary.Payload,
+		},
+		Topics: []string{j.Session},
+	}
+	yt.OutCh <- m
+
+	return primary, true
+}
+
+// Existing reports the library item info as the result of j, for requests whose output already exists.
+func (yt *Download) Existing(j *jobs.Job, info Info) {
+	info.Id = j.ID
+	info.Source = JobKey(j)
+	yt.send(j, util.Msg{Key: KeyLinkStream, Value: info})
+	yt.send(j, util.Msg{Key: KeyCompleted, Value: info})
+	yt.finished(j, jobs.StateDone)
+}
+
+// finished records the final state of j and the jobs attached to it, then releases its claim.
+func (yt *Download) finished(j *jobs.Job, state jobs.State) {
+	key := JobKey(j)
+
+	yt.Lock()
+	var attached []*jobs.Job
+	if f, ok := yt.inflight[key]; ok && f.primary.ID == j.ID {
+		attached = f.attached
+		delete(yt.inflight, key)
+	}
+	yt.Unlock()
+
+	yt.groupChildDone(j, state)
+	for _, a := range attached {
+		yt.groupChildDone(a, state)
+	}
+}
+
+// topics returns the SSE topics of the sessions interested in j's messages.
+func (yt *Download) topics(j *jobs.Job) []string {
+	topics := []string{j.Session}
+
+	yt.RLock()
+	defer yt.RUnlock()
+	if f, ok := yt.inflight[JobKey(j)]; ok && f.primary.ID == j.ID {
+		for _, a := range f.attached {
+			if !slices.Contains(topics, a.Session) {
+				topics = append(topics, a.Session)
+			}
+		}
+	}
+	return topics
+}
@@ -2,6 +2,7 @@ package ytworker
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/md5"
 	"encoding/json"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/porjo/ytdl-web/internal/command"
 	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/metrics"
 	"github.com/porjo/ytdl-web/internal/util"
 )
 
@@ -29,6 +31,11 @@ const (
 
 	MaxFileSize = 1 << 20 * 500 // 500 MiB
 
+	DefaultVideoMaxHeight = 720
+
+	// bitrate in kbit/s of mp3 files converted to Opus without a profile
+	legacyOpusBitrate = 32.0
+
 	YtdlpSocketTimeoutSec = 10
 
 	KeyCompleted  = "completed"
@@ -36,15 +43,25 @@ const (
 	KeyInfo       = "info"
 	KeyError      = "error"
 	KeyLinkStream = "link_stream"
+	KeyQueued     = "queued"
+	KeyCancelled  = "cancelled"
+	// the download has finished and yt-dlp has started post-processing
+	KeyPostProcessing = "post_processing"
+
+	ModeAudio = "audio"
+	ModeVideo = "video"
 
-	// temporary directory relative to output directory
-	tmpDir = "t"
+	// TmpDir is the temporary directory relative to output directory
+	TmpDir = "t"
 )
 
 var (
 	// capture progress output e.g '100 of 10000000 / 10000000 eta 30'
 	ytProgressRe = regexp.MustCompile(`([\d]+) of ([\dNA]+) / ([\d.NA]+) eta ([\d]+)`)
 
+	// output of yt-dlp postprocessors that run after the download e.g. '[ExtractAudio] Destination: x.opus'
+	ytPostProcessRe = regexp.MustCompile(`^\[(ExtractAudio|Merger|ModifyChapters|Metadata|Fixup\w*|VideoConvertor|VideoRemuxer)\]`)
+
 	// filename sanitization
 	// swap specific special characters
 	filenameReplacer = strings.NewReplacer(
@@ -62,15 +79,35 @@ var (
 	filenameRegexp = regexp.MustCompile("[^0-9A-Za-z_ +,-]+")
 )
 
+// ErrNoSpace is returned when a download doesn't fit in the library quota.
+var ErrNoSpace = errors.New("not enough space in the library")
+
+// Storage keeps the library within its size budget, making room for downloads.
+type Storage interface {
+	// Available returns the largest download that could fit.
+	Available() int64
+	// Reserve makes room for a download of size bytes by the job id, or returns an error wrapping [ErrNoSpace].
+	Reserve(id, size int64) error
+	// Release frees the room reserved for the job id.
+	Release(id int64)
+}
+
 type YTInfo struct {
 	Title   string
 	Channel string
 	Series  string
 	//Description          string
 	FileSize             int64
-	Extension            string        `json:"ext"`
-	SponsorBlockChapters []interface{} `json:"sponsorblock_chapters"`
-	AudioCodec           string        `json:"acodec"`
+	FileSizeApprox       int64            `json:"filesize_approx"`
+	Extension            string           `json:"ext"`
+	SponsorBlockChapters []sponsorSegment `json:"sponsorblock_chapters"`
+	Chapters             []ytChapter      `json:"chapters"`
+	AudioCodec           string           `json:"acodec"`
+	Duration             float64
+	// audio sample rate in Hz and bitrate in kbit/s
+	SampleRate float64 `json:"asr"`
+	Bitrate    float64 `json:"abr"`
+	Channels   int     `json:"audio_channels"`
 }
 type Info struct {
 	Id     int64
@@ -81,6 +118,17 @@ type Info struct {
 	Extension    string
 	DownloadURL  string
 	SponsorBlock bool
+	Video        bool
+
+	// Source identifies the request that produced the file, see [JobKey]
+	Source string `json:"-"`
+
+	// Chapters are timed for the output file, with SponsorBlock segments removed
+	Chapters []Chapter `json:",omitempty"`
+	// Tempo the file was rendered at, zero if unchanged
+	Tempo float64 `json:",omitempty"`
+	// SilenceTrimmed is set if long silences were removed
+	SilenceTrimmed bool `json:",omitempty"`
 
 	Progress Progress
 }
@@ -89,6 +137,9 @@ type Progress struct {
 	Pct      float32
 	FileSize int64
 	ETA      string
+
+	// Downloaded is the number of bytes of the current file downloaded so far
+	Downloaded int64 `json:"-"`
 }
 type Misc struct {
 	Id  int64
@@ -107,16 +158,33 @@ type Download struct {
 	sponsorBlock     bool
 	sponsorBlockCats string
 	ytCmd            string
+	videoMaxHeight   int
+	profiles         map[string]Profile
+	policy           *URLPolicy
+	storage          Storage
+	retry            RetryPolicy
+	// subtitle languages in order of preference, none disables subtitles
+	subLangs       []string
+	postProcessing PostProcessing
+
+	// final download URL of completed stream files, keyed by stream file path relative to web root
+	completedStreams map[string]string
+
+	// playlist groups with unfinished jobs, keyed by group ID
+	groups map[int64]*group
+
+	// queued and running jobs, keyed by [JobKey]
+	inflight map[string]*inflight
 
 	ctx context.Context
 }
 
-func NewDownload(ctx context.Context, webroot, outPath string, sponsorBlock bool, sponsorBlockCats string, ytCmd string, maxProcessTime time.Duration) (*Download, error) {
+func NewDownload(ctx context.Context, webroot, outPath string, sponsorBlock bool, sponsorBlockCats string, ytCmd string, maxProcessTime time.Duration, videoMaxHeight int, profiles map[string]Profile, policy *URLPolicy, storage Storage, retry RetryPolicy, subLangs string, postProcessing PostProcessing) (*Download, error) {
 
 	outPathFull := filepath.Join(webroot, outPath)
 
 	// create tmp dir (and output path if necessary)
-	if err := os.MkdirAll(filepath.Join(outPathFull, tmpDir), os.ModePerm); err != nil {
+	if err := os.MkdirAll(filepath.Join(outPathFull, TmpDir), os.ModePerm); err != nil {
 		return nil, err
 	}
 
@@ -124,6 +192,16 @@ func NewDownload(ctx context.Context, webroot, outPath string, sponsorBlock bool
 		maxProcessTime = DefaultMaxProcessTime
 	}
 
+	if videoMaxHeight <= 0 {
+		videoMaxHeight = DefaultVideoMaxHeight
+	}
+
+	if policy != nil && !policy.AllowPrivate {
+		if err := policy.startProxy(ctx); err != nil {
+			return nil, err
+		}
+	}
+
 	dl := &Download{
 		maxProcessTime:   maxProcessTime,
 		outPath:          outPath,
@@ -131,6 +209,16 @@ func NewDownload(ctx context.Context, webroot, outPath string, sponsorBlock bool
 		sponsorBlock:     sponsorBlock,
 		sponsorBlockCats: sponsorBlockCats,
 		ytCmd:            ytCmd,
+		videoMaxHeight:   videoMaxHeight,
+		profiles:         profiles,
+		policy:           policy,
+		storage:          storage,
+		retry:            retry,
+		subLangs:         splitList(subLangs),
+		postProcessing:   postProcessing,
+		completedStreams: make(map[string]string),
+		groups:           make(map[int64]*group),
+		inflight:         make(map[string]*inflight),
 		ctx:              ctx,
 	}
 	dl.OutCh = make(chan util.Msg, 10)
@@ -145,43 +233,128 @@ func NewDownload(ctx context.Context, webroot, outPath string, sponsorBlock bool
 }
 
 // Work is called by [jobs.Dispatcher] for each job in the queue.
-func (yt *Download) Work(j *jobs.Job) {
+// The returned error is recorded as the job's outcome.
+func (yt *Download) Work(ctx context.Context, j *jobs.Job) error {
 
-	id := time.Now().UnixMicro()
-
-	ctx, cancel := context.WithTimeout(yt.ctx, yt.maxProcessTime)
-	defer cancel()
+	id := j.ID
 
 	url, err := url.Parse(j.Payload)
 	if err != nil {
 		slog.Error("unable to parse job URL", "url", j.Payload, "error", err)
-		return
+		yt.finished(j, jobs.StateFailed)
+		return err
 	}
 
-	err = yt.download(ctx, id, yt.OutCh, url)
+	err = yt.downloadWithRetry(ctx, j, url)
+	if errors.Is(context.Cause(ctx), jobs.ErrCancelled) {
+		slog.Info("download cancelled", "id", id, "url", url.String())
+		// the process group has been killed, remove whatever it left behind
+		yt.removeTmpFiles(j)
+		yt.Cancelled(j)
+		return jobs.ErrCancelled
+	}
 	if err != nil {
 		slog.Error("download() error", "error", err)
+		if yt.ctx.Err() != nil {
+			// shutting down, OutCh is closed
+			return err
+		}
 		val := Misc{
 			Id:  id,
 			Msg: err.Error(),
 		}
 		m := util.Msg{Key: KeyError, Value: val}
-		yt.OutCh <- m
-		return
+		yt.send(j, m)
+		yt.finished(j, jobs.StateFailed)
+		return err
+	}
+
+	yt.finished(j, jobs.StateDone)
+	return nil
+}
+
+// CheckURL returns an error wrapping [ErrURLNotAllowed] if rawURL may not be downloaded under the URL policy.
+func (yt *Download) CheckURL(ctx context.Context, rawURL string) error {
+	return yt.policy.Check(ctx, rawURL)
+}
+
+// Queued notifies the job's session that the job is waiting for a free worker.
+// The job is claimed for deduplication if no identical job is in flight, see [Download.Claim].
+func (yt *Download) Queued(j *jobs.Job) {
+	yt.Lock()
+	if _, ok := yt.inflight[JobKey(j)]; !ok {
+		yt.inflight[JobKey(j)] = &inflight{primary: j}
+	}
+	yt.Unlock()
+
+	m := util.Msg{
+		Key: KeyQueued,
+		Value: Misc{
+			Id:  j.ID,
+			Msg: j.Payload,
+		},
 	}
+	yt.send(j, m)
+}
 
+// Cancelled notifies the job's session that the job was cancelled.
+func (yt *Download) Cancelled(j *jobs.Job) {
+	m := util.Msg{
+		Key: KeyCancelled,
+		Value: Misc{
+			Id:  j.ID,
+			Msg: "",
+		},
+	}
+	yt.send(j, m)
+	yt.finished(j, jobs.StateCancelled)
 }
 
-func (yt *Download) download(ctx context.Context, id int64, outCh chan<- util.Msg, url *url.URL) error {
+// send passes the message to OutCh, addressed to the session that submitted the job
+// and any sessions attached to it.
+func (yt *Download) send(j *jobs.Job, m util.Msg) {
+	m.Topics = yt.topics(j)
+	yt.OutCh <- m
 
-	// filename is md5 sum of URL
-	urlSum := md5.Sum([]byte(url.String()))
-	diskFileNameTmp := filepath.Join(yt.webRoot, yt.outPath, "t", "ytdl-"+fmt.Sprintf("%x", urlSum))
+	if info, ok := m.Value.(Info); ok && j.Group != 0 && m.Key == KeyInfo {
+		yt.groupProgress(j, info.Progress.Pct)
+	}
+}
+
+func (yt *Download) download(ctx context.Context, id int64, j *jobs.Job, url *url.URL) error {
+
+	// jobs resumed from the journal were accepted under the policy in force at the time
+	if err := yt.policy.Check(ctx, url.String()); err != nil {
+		return err
+	}
+
+	diskFileNameTmp := yt.tmpFileName(j)
+	video := j.Options.Mode == ModeVideo
+
+	var profile *Profile
+	if j.Options.Profile != "" && !video {
+		p, ok := yt.profiles[j.Options.Profile]
+		if !ok {
+			return fmt.Errorf("unknown profile '%s'", j.Options.Profile)
+		}
+		profile = &p
+	}
+
+	maxFileSize := int64(MaxFileSize)
+	if yt.storage != nil {
+		// refuse files that can't fit before downloading them
+		avail := yt.storage.Available()
+		if avail <= 0 {
+			return fmt.Errorf("%w: pinned files fill the library", ErrNoSpace)
+		}
+		maxFileSize = min(maxFileSize, avail)
+		defer yt.storage.Release(id)
+	}
 
 	slog.Info("Fetching url", "url", url.String())
 	args := []string{
 		"--write-info-json",
-		"--max-filesize", fmt.Sprintf("%d", int(MaxFileSize)),
+		"--max-filesize", fmt.Sprintf("%d", maxFileSize),
 
 		// output progress bar as newlines
 		"--newline",
@@ -194,36 +367,59 @@ func (yt *Download) download(ctx context.Context, id int64, outCh chan<- util.Ms
 		"--no-playlist",
 		"-o", diskFileNameTmp + ".%(ext)s",
 		"--embed-metadata",
+		// yt-dlp moves the embedded chapters for removed SponsorBlock segments the same way as outputChapters
+		"--embed-chapters",
 
-		// extract audio
-		"-x",
 		// print final output filename (after postprocessing etc)
 		"--print-to-file", "after_move:filepath", diskFileNameTmp + ".ext",
+	}
+
+	if video {
+		args = append(args, []string{
+			// best video up to the maximum height, preferring H.264/AAC in MP4 as every browser can play it
+			"-f", "bv*+ba/b",
+			"-S", fmt.Sprintf("res:%d,vcodec:h264,acodec:aac,ext:mp4:m4a", yt.videoMaxHeight),
+			"--merge-output-format", "mp4/webm",
+		}...)
+	} else {
+		args = append(args, []string{
+			// extract audio
+			"-x",
 
-		// proto:dash is needed for fast Youtube downloads
-		// sort by size, bitrate in ascending order
-		//"-S", "proto:dash,+size,+br",
+			// proto:dash is needed for fast Youtube downloads
+			// sort by size, bitrate in ascending order
+			//"-S", "proto:dash,+size,+br",
 
-		// Faster youtube downloads: this combined with -S proto:dash ensures that we get dash https://github.com/yt-dlp/yt-dlp/issues/7417
-		//"--extractor-args", "youtube:formats=duplicate",
+			// Faster youtube downloads: this combined with -S proto:dash ensures that we get dash https://github.com/yt-dlp/yt-dlp/issues/7417
+			//"--extractor-args", "youtube:formats=duplicate",
 
-		// prefer best audio-only format, otherwise fallback to best any format
-		"-f", "bestaudio/best",
+			// prefer best audio-only format, otherwise fallback to best any format
+			"-f", "bestaudio/best",
+		}...)
 	}
 
+	// video containers don't all support cover art, webm doesn't
+	args = append(args, artworkArgs(!video && (profile == nil || profile.embedsArtwork()))...)
+	args = append(args, subtitleArgs(yt.subLangs)...)
+
 	if yt.sponsorBlock {
 		args = append(args, []string{
 			"--sponsorblock-remove", yt.sponsorBlockCats,
 		}...)
 	}
-	args = append(args, []string{
-		// re-encode mp3 to opus, leave opus as-is, otherwise remux to m4a (re-encode to aac)
-		"--audio-format", "mp3>opus/opus>opus/webm>opus/m4a",
-		// Use 32K bitrate.
-		// This only applies to mp3>opus conversion. Other input formats will retain original bitrate.
-		"--audio-quality", "32K",
-		//	"--postprocessor-args", `ExtractAudio:-compression_level 0`,  // fastest, lowest quality compression
-	}...)
+	if profile != nil {
+		args = append(args, profile.args()...)
+	} else if !video {
+		args = append(args, []string{
+			// re-encode mp3 to opus, leave opus as-is, otherwise remux to m4a (re-encode to aac)
+			"--audio-format", "mp3>opus/opus>opus/webm>opus/m4a",
+			// Use 32K bitrate.
+			// This only applies to mp3>opus conversion. Other input formats will retain original bitrate.
+			"--audio-quality", fmt.Sprintf("%.0fK", legacyOpusBitrate),
+			//	"--postprocessor-args", `ExtractAudio:-compression_level 0`,  // fastest, lowest quality compression
+		}...)
+	}
+	args = append(args, yt.policy.args()...)
 	args = append(args, url.String())
 
 	slog.Info("Running command", "command", append([]string{yt.ytCmd}, args...))
@@ -237,18 +433,54 @@ func (yt *Download) download(ctx context.Context, id int64, outCh chan<- util.Ms
 
 	infoFileName := diskFileNameTmp + ".info.json"
 
+	// yt-dlp's ERROR lines explain why it failed
+	var errLines errorLines
+	// cmdFailed reads the rest of the output once the command has reported an error
+	cmdFailed := func(err error) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return errLines.wrap(err)
+			case line, open := <-cmdOutCh:
+				if !open {
+					return errLines.wrap(err)
+				}
+				errLines.note(line)
+				m := util.Msg{Key: KeyUnknown, Value: Misc{Id: id, Msg: line}}
+				yt.send(j, m)
+			}
+		}
+	}
+
 	infoCheck := func() error {
 		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
 		count := 0
+		// the channels are closed when the command exits, stop reading them then
+		outCh, errCh := cmdOutCh, cmdErrCh
 		for {
 			select {
-			case line := <-cmdOutCh:
+			case <-ctx.Done():
+				return ctx.Err()
+			case err, open := <-errCh:
+				if !open {
+					errCh = nil
+					continue
+				}
+				// failed before writing the info file
+				return cmdFailed(err)
+			case line, open := <-outCh:
+				if !open {
+					outCh = nil
+					continue
+				}
+				errLines.note(line)
 				misc := Misc{
 					Id:  id,
 					Msg: line,
 				}
 				m := util.Msg{Key: KeyUnknown, Value: misc}
-				outCh <- m
+				yt.send(j, m)
 			case <-ticker.C:
 				_, err := os.Stat(infoFileName)
 				if err == nil {
@@ -292,24 +524,48 @@ func (yt *Download) download(ctx context.Context, id int64, outCh chan<- util.Ms
 	info.FileSize = ytInfo.FileSize
 	info.Extension = ytInfo.Extension
 	info.SponsorBlock = len(ytInfo.SponsorBlockChapters) > 0
+	info.Chapters = outputChapters(ytInfo.Chapters, ytInfo.SponsorBlockChapters)
+	info.Video = video
+	info.Source = JobKey(j)
 
 	if info.FileSize > MaxFileSize {
 		return fmt.Errorf("filesize %d too large", info.FileSize)
 	}
 
+	// make room in the library once the size is known, from the info or else the first progress report
+	reserved := false
+	reserve := func(size int64) error {
+		if yt.storage == nil || reserved || size <= 0 {
+			return nil
+		}
+		reserved = true
+		return yt.storage.Reserve(id, size)
+	}
+	if err := reserve(cmp.Or(ytInfo.FileSize, ytInfo.FileSizeApprox)); err != nil {
+		return err
+	}
+
 	m := util.Msg{Key: KeyInfo, Value: info}
-	outCh <- m
+	yt.send(j, m)
 
 	opusEncode := false
 
 	// output size of opus file as it gets written
-	if ytInfo.AudioCodec == "mp3" {
-		opusEncode = true
+	if !video {
+		if profile == nil {
+			opusEncode = ytInfo.AudioCodec == "mp3"
+		} else {
+			opusEncode = profile.Codec == "opus" && ytInfo.AudioCodec != "opus"
+		}
 	}
+	// the legacy conversion only re-encodes mp3, otherwise audio is copied where the codec already matches,
+	// unless it has to be encoded again to match the profile
+	reencode := !video && profile != nil && profile.reencode(ytInfo)
+	transcoded := opusEncode || reencode || (profile != nil && !profile.sameCodec(ytInfo.AudioCodec))
 
 	if opusEncode {
 		go func() {
-			err := getOpusFileSize(ctx, id, info, outCh, diskFileNameTmp+".opus", yt.outPath)
+			err := yt.getOpusFileSize(ctx, id, info, j, diskFileNameTmp+".opus")
 			if err != nil {
 				slog.Error("getOpusFileSize error", "error", err)
 			}
@@ -319,24 +575,36 @@ func (yt *Download) download(ctx context.Context, id int64, outCh chan<- util.Ms
 	// var startDownload time.Time
 	var line string
 	var open bool
+	postProcessing := false
+	var downloaded int64
 loop:
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Info("download, context done")
-			return nil
+			return ctx.Err()
 		case err, open := <-cmdErrCh:
 			if !open {
 				break loop
 			}
-			return err
+			return cmdFailed(err)
 		case line, open = <-cmdOutCh:
 			if !open {
 				break loop
 			}
+			errLines.note(line)
 
 			p := getYTProgress(line)
 			if p != nil {
+				if err := reserve(p.FileSize); err != nil {
+					return err
+				}
+				// progress restarts from zero for each file, e.g. separate video and audio formats
+				if p.Downloaded < downloaded {
+					downloaded = 0
+				}
+				metrics.DownloadedBytes.Add(float64(p.Downloaded - downloaded))
+				downloaded = p.Downloaded
 				m := util.Msg{
 					Key: KeyInfo,
 					Value: Info{
@@ -344,17 +612,23 @@ loop:
 						Artist:   info.Artist,
 						Title:    info.Title,
 						FileSize: info.FileSize,
+						Video:    info.Video,
 						Progress: *p,
 					},
 				}
-				outCh <- m
+				yt.send(j, m)
 			} else {
+				if !postProcessing && ytPostProcessRe.MatchString(line) {
+					postProcessing = true
+					m := util.Msg{Key: KeyPostProcessing, Value: Misc{Id: id, Msg: line}}
+					yt.send(j, m)
+				}
 				misc := Misc{
 					Id:  id,
 					Msg: line,
 				}
 				m := util.Msg{Key: KeyUnknown, Value: misc}
-				outCh <- m
+				yt.send(j, m)
 			}
 		}
 	}
@@ -373,6 +647,42 @@ loop:
 		diskFileNameTmp2 = string(diskFileNameTmp2b[:idx])
 	}
 
+	normalize := j.Options.Normalize || (profile != nil && profile.Normalize)
+	// segments removed as silence, for moving the transcript
+	var silences []sponsorSegment
+	if normalize || j.Options.TrimSilence || j.Options.Tempo > 0 || reencode {
+		if !postProcessing {
+			m := util.Msg{Key: KeyPostProcessing, Value: Misc{Id: id, Msg: "post-processing with ffmpeg"}}
+			yt.send(j, m)
+		}
+		out := audioOutput{
+			sampleRate: int(ytInfo.SampleRate),
+			bitrate:    ytInfo.Bitrate,
+			duration:   ytInfo.Duration - removedSeconds(ytInfo.SponsorBlockChapters),
+			reencode:   reencode,
+		}
+		if profile != nil {
+			out.codec = profile.Codec
+			if profile.SampleRate > 0 {
+				out.sampleRate = profile.SampleRate
+			}
+			if b, err := parseBitrate(profile.Bitrate); err == nil {
+				out.bitrate = b
+			}
+			out.channels = profile.Channels
+		} else if opusEncode {
+			// the legacy conversion sets the bitrate
+			out.bitrate = legacyOpusBitrate
+		}
+		silences, err = yt.postProcess(ctx, j, info, diskFileNameTmp2, normalize, out)
+		if err != nil {
+			return err
+		}
+		info.Chapters = processedChapters(info.Chapters, silences, j.Options.Tempo)
+		info.Tempo = j.Options.Tempo
+		info.SilenceTrimmed = j.Options.TrimSilence
+	}
+
 	if info.Title == "" {
 		info.Title = "unknown"
 	}
@@ -391,8 +701,19 @@ loop:
 	if len(sanitizedTitle) > 100 {
 		sanitizedTitle = sanitizedTitle[:100]
 	}
+	// keep processed versions alongside the original
+	if info.Tempo > 0 {
+		sanitizedTitle += fmt.Sprintf(" %gx", info.Tempo)
+	}
+	if info.SilenceTrimmed {
+		sanitizedTitle += " trimmed"
+	}
 
-	finalFileNameNoExt := filepath.Join(yt.webRoot, yt.outPath, sanitizedTitle)
+	libraryDir := filepath.Join(yt.webRoot, yt.outPath, filepath.FromSlash(j.Options.Library))
+	if err := os.MkdirAll(libraryDir, os.ModePerm); err != nil {
+		return err
+	}
+	finalFileNameNoExt := filepath.Join(libraryDir, sanitizedTitle)
 
 	ext := path.Ext(diskFileNameTmp2)
 	// rename .opus to .oga. It's already an OGG container and most clients prefer .oga extension.
@@ -413,33 +734,103 @@ loop:
 				Msg: fmt.Sprintf("opus file size %.2f MB\n", float32(fi.Size())*1e-6),
 			},
 		}
-		outCh <- m
+		yt.send(j, m)
+	}
+	if transcoded {
+		if fi, err := os.Stat(diskFileNameTmp2); err == nil {
+			metrics.TranscodedBytes.Add(float64(fi.Size()))
+		}
 	}
 	slog.Info("rename file", "src", diskFileNameTmp2, "dst", finalFileName)
 	err = os.Rename(diskFileNameTmp2, finalFileName)
 	if err != nil {
 		return err
 	}
+	if err := moveArtwork(diskFileNameTmp, finalFileName); err != nil {
+		slog.Error("artwork move error", "error", err)
+	}
+	if err := moveTranscript(diskFileNameTmp, finalFileName, yt.subLangs); err != nil {
+		slog.Error("transcript move error", "error", err)
+	} else if info.Tempo > 0 || info.SilenceTrimmed {
+		transcript := TranscriptFile(finalFileName)
+		if _, err := os.Stat(transcript); err == nil {
+			if err := retimeTranscript(transcript, silences, info.Tempo); err != nil {
+				slog.Error("transcript retime error", "error", err)
+			}
+		}
+	}
 
-	info.DownloadURL = filepath.Join(yt.outPath, filepath.Base(finalFileName))
+	info.DownloadURL = filepath.Join(yt.outPath, filepath.FromSlash(j.Options.Library), filepath.Base(finalFileName))
+	if opusEncode {
+		// clients may still be streaming from the temporary file
+		yt.Lock()
+		yt.completedStreams[filepath.Join(yt.outPath, TmpDir, filepath.Base(diskFileNameTmp2))] = info.DownloadURL
+		yt.Unlock()
+	}
 	// don't send link for opusEncode as that's handled in getOpusFileSize goroutine
 	if !opusEncode {
 		m := util.Msg{Key: KeyLinkStream, Value: info}
-		outCh <- m
+		yt.send(j, m)
 	}
 
-	m = util.Msg{
-		Key: KeyCompleted,
-		Value: Misc{
-			Id:  id,
-			Msg: "",
-		},
-	}
-	outCh <- m
+	// completion carries the final download URL so the library can be updated
+	m = util.Msg{Key: KeyCompleted, Value: info}
+	yt.send(j, m)
 
 	return nil
 }
 
+// CompletedStream returns the download URL of the finished file that was streamed
+// from streamFile while it was being encoded. Both paths are relative to the web root.
+func (yt *Download) CompletedStream(streamFile string) (string, bool) {
+	yt.RLock()
+	defer yt.RUnlock()
+	u, ok := yt.completedStreams[filepath.Clean(streamFile)]
+	return u, ok
+}
+
+// TmpLibrary returns the library of the queued or running job that writes the temporary file named name,
+// so that only its user can stream it.
+func (yt *Download) TmpLibrary(name string) (string, bool) {
+	yt.RLock()
+	defer yt.RUnlock()
+	for _, f := range yt.inflight {
+		if strings.HasPrefix(name, filepath.Base(yt.tmpFileName(f.primary))+".") {
+			return f.primary.Options.Library, true
+		}
+	}
+	return "", false
+}
+
+// tmpFileName returns the path, without extension, that temporary files for the job are written to.
+func (yt *Download) tmpFileName(j *jobs.Job) string {
+	// filename is md5 sum of normalized URL and output settings
+	urlSum := md5.Sum([]byte(JobKey(j)))
+	return filepath.Join(yt.webRoot, yt.outPath, TmpDir, "ytdl-"+fmt.Sprintf("%x", urlSum))
+}
+
+// removeTmpFiles removes all temporary files written for the job.
+func (yt *Download) removeTmpFiles(j *jobs.Job) {
+	files, err := filepath.Glob(yt.tmpFileName(j) + ".*")
+	if err != nil {
+		slog.Error("tmp file glob error", "error", err)
+		return
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			slog.Error("tmp file remove error", "file", f, "error", err)
+			continue
+		}
+		slog.Debug("tmp file removed", "file", f)
+	}
+}
+
+// SidecarFiles returns the paths of the files that may be kept alongside the library item at filename:
+// its cover art and transcript. They go wherever the item goes.
+func SidecarFiles(filename string) []string {
+	return []string{ArtworkFile(filename), TranscriptFile(filename)}
+}
+
 func getYTProgress(v string) *Progress {
 	matches := ytProgressRe.FindStringSubmatch(v)
 
@@ -448,7 +839,7 @@ func getYTProgress(v string) *Progress {
 	var p *Progress
 	if len(matches) == 5 {
 		p = new(Progress)
-		downloaded, _ := strconv.Atoi(matches[1])
+		downloaded, _ := strconv.ParseInt(matches[1], 10, 64)
 		var total int64
 		// if total_bytes is missing, try total_bytes_estimate
 		if matches[2] != "NA" {
@@ -462,12 +853,13 @@ func getYTProgress(v string) *Progress {
 		eta, _ := strconv.Atoi(matches[4])
 		p.Pct = float32(downloaded) / float32(total) * 100.0
 		p.FileSize = total
+		p.Downloaded = downloaded
 		p.ETA = fmt.Sprintf("%v", time.Duration(eta)*time.Second)
 	}
 	return p
 }
 
-func getOpusFileSize(ctx context.Context, id int64, info Info, outCh chan<- util.Msg, filename, webPath string) error {
+func (yt *Download) getOpusFileSize(ctx context.Context, id int64, info Info, j *jobs.Job, filename string) error {
 	var startTime time.Time
 	streamURLSent := false
 
@@ -490,9 +882,9 @@ func getOpusFileSize(ctx context.Context, id int64, info Info, outCh chan<- util
 
 			// wait until we have some data before sending stream URL
 			if !streamURLSent && opusFI.Size() > 10000 {
-				info.DownloadURL = filepath.Join(webPath, "stream", "t", filepath.Base(filename))
+				info.DownloadURL = filepath.Join(yt.outPath, "stream", "t", filepath.Base(filename))
 				m := util.Msg{Key: KeyLinkStream, Value: info}
-				outCh <- m
+				yt.send(j, m)
 				streamURLSent = true
 			}
 
@@ -525,7 +917,7 @@ func getOpusFileSize(ctx context.Context, id int64, info Info, outCh chan<- util
 							},
 						},
 					}
-					outCh <- m
+					yt.send(j, m)
 				}
 			}
 			m := util.Msg{
@@ -535,7 +927,7 @@ func getOpusFileSize(ctx context.Context, id int64, info Info, outCh chan<- util
 					Msg: fmt.Sprintf("opus file size %.2f MB\n", float32(opusFI.Size())*1e-6),
 				},
 			}
-			outCh <- m
+			yt.send(j, m)
 		}
 	}
 }
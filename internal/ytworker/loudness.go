@@ -0,0 +1,72 @@
+package ytworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	// DefaultLoudnessTarget is the integrated loudness in LUFS recommended for podcasts
+	DefaultLoudnessTarget = -16.0
+	// DefaultTruePeak is the true peak limit in dBTP
+	DefaultTruePeak = -1.5
+
+	// loudness range target, ffmpeg's default
+	loudnessRange = 11.0
+)
+
+// Loudness configures EBU R128 loudness normalization, applied with two passes of ffmpeg's loudnorm filter:
+// the first measures the file, the second corrects it linearly where possible.
+type Loudness struct {
+	// Target is the integrated loudness in LUFS
+	Target float64
+	// TruePeak is the maximum true peak in dBTP
+	TruePeak float64
+}
+
+// loudnormStats is the measurement printed by the first pass
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureFilter returns the filter of the first pass, which prints the measurement.
+func (l Loudness) measureFilter() string {
+	return l.filter() + ":print_format=json"
+}
+
+// correctFilter returns the filter of the second pass, given the measurement of the first.
+func (l Loudness) correctFilter(stats *loudnormStats) string {
+	return fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		l.filter(), stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset)
+}
+
+func (l Loudness) filter() string {
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", l.Target, l.TruePeak, loudnessRange)
+}
+
+// parseLoudnorm returns the measurement printed by loudnorm as the last JSON object of ffmpeg's log.
+func parseLoudnorm(log []byte) (*loudnormStats, error) {
+	start := bytes.LastIndexByte(log, '{')
+	end := bytes.LastIndexByte(log, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("loudness measurement not found in ffmpeg output")
+	}
+	var stats loudnormStats
+	if err := json.Unmarshal(log[start:end+1], &stats); err != nil {
+		return nil, fmt.Errorf("loudness measurement: %w", err)
+	}
+	// silence measures as -inf, which loudnorm won't take back
+	for _, v := range []string{stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset} {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("loudness measurement '%s' unusable", v)
+		}
+	}
+	return &stats, nil
+}
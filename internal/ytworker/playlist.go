@@ -0,0 +1,197 @@
+package ytworker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/command"
+	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/util"
+)
+
+const (
+	// maximum number of playlist entries expanded into jobs
+	MaxPlaylistItems = 100
+
+	KeyGroup          = "group"
+	KeyGroupCompleted = "group_completed"
+)
+
+// Playlist is the result of expanding a playlist or channel URL.
+type Playlist struct {
+	Title string
+	URLs  []string
+}
+
+type ytPlaylist struct {
+	Title   string
+	Entries []struct {
+		URL        string
+		WebpageURL string `json:"webpage_url"`
+	}
+}
+
+// GroupProgress is the aggregate progress of the jobs expanded from a playlist.
+type GroupProgress struct {
+	Id        int64
+	Title     string
+	Total     int
+	Completed int
+	Failed    int
+	Cancelled int
+	Pct       float32
+}
+
+type group struct {
+	GroupProgress
+
+	session  string
+	pct      map[int64]float32 // progress of running children
+	lastSent time.Time
+}
+
+// ExpandPlaylist lists the entries of a playlist or channel using yt-dlp's flat extraction, without downloading them.
+// items is an optional yt-dlp playlist item selection, e.g. '1-10' or '1,3,5'.
+// At most MaxPlaylistItems entries are returned.
+func (yt *Download) ExpandPlaylist(ctx context.Context, url, items string) (*Playlist, error) {
+	args := []string{
+		"--flat-playlist",
+		"--dump-single-json",
+		"--socket-timeout", fmt.Sprintf("%d", YtdlpSocketTimeoutSec),
+		"--playlist-end", fmt.Sprintf("%d", MaxPlaylistItems),
+	}
+	if items != "" {
+		args = append(args, "--playlist-items", items)
+	}
+	args = append(args, yt.policy.args()...)
+	args = append(args, url)
+
+	slog.Info("Running command", "command", append([]string{yt.ytCmd}, args...))
+	out, err := command.RunCommand(ctx, yt.ytCmd, args...)
+	if err != nil {
+		return nil, fmt.Errorf("playlist expansion failed: %w", err)
+	}
+
+	var ytp ytPlaylist
+	if err := json.Unmarshal(out, &ytp); err != nil {
+		return nil, fmt.Errorf("playlist json unmarshal error: %w", err)
+	}
+
+	p := &Playlist{Title: ytp.Title}
+	for _, e := range ytp.Entries {
+		u := e.URL
+		if u == "" {
+			u = e.WebpageURL
+		}
+		if u == "" {
+			continue
+		}
+		p.URLs = append(p.URLs, u)
+		if len(p.URLs) == MaxPlaylistItems {
+			break
+		}
+	}
+	if len(p.URLs) == 0 {
+		return nil, fmt.Errorf("playlist has no entries")
+	}
+
+	return p, nil
+}
+
+// NewGroup starts tracking the jobs expanded from a playlist and notifies their session.
+func (yt *Download) NewGroup(id int64, title string, children []*jobs.Job) {
+	if len(children) == 0 {
+		return
+	}
+	g := &group{
+		GroupProgress: GroupProgress{
+			Id:    id,
+			Title: title,
+			Total: len(children),
+		},
+		session: children[0].Session,
+		pct:     make(map[int64]float32),
+	}
+
+	yt.Lock()
+	yt.groups[id] = g
+	yt.Unlock()
+
+	yt.sendGroup(g, KeyGroup)
+}
+
+// groupProgress records the progress of a child job, sending the group's aggregate progress at most every 500ms.
+func (yt *Download) groupProgress(j *jobs.Job, pct float32) {
+	yt.Lock()
+	g, ok := yt.groups[j.Group]
+	if !ok {
+		yt.Unlock()
+		return
+	}
+	g.pct[j.ID] = min(pct, 100)
+	g.Pct = g.aggregate()
+	if time.Since(g.lastSent) < 500*time.Millisecond {
+		yt.Unlock()
+		return
+	}
+	g.lastSent = time.Now()
+	gp := g.GroupProgress
+	yt.Unlock()
+
+	yt.OutCh <- util.Msg{Key: KeyGroup, Value: gp, Topics: []string{g.session}}
+}
+
+// groupChildDone records that a child job has finished with the given state. Once all children
+// have finished, a group completed message is sent.
+func (yt *Download) groupChildDone(j *jobs.Job, state jobs.State) {
+	yt.Lock()
+	g, ok := yt.groups[j.Group]
+	if !ok {
+		yt.Unlock()
+		return
+	}
+	switch state {
+	case jobs.StateDone:
+		g.Completed++
+	case jobs.StateCancelled:
+		g.Cancelled++
+	default:
+		g.Failed++
+	}
+	delete(g.pct, j.ID)
+	g.Pct = g.aggregate()
+	finished := g.Completed+g.Failed+g.Cancelled >= g.Total
+	if finished {
+		delete(yt.groups, g.Id)
+	}
+	yt.Unlock()
+
+	if finished {
+		yt.sendGroup(g, KeyGroupCompleted)
+	} else {
+		yt.sendGroup(g, KeyGroup)
+	}
+}
+
+func (yt *Download) sendGroup(g *group, key string) {
+	yt.RLock()
+	gp := g.GroupProgress
+	yt.RUnlock()
+	yt.OutCh <- util.Msg{Key: key, Value: gp, Topics: []string{g.session}}
+}
+
+// aggregate returns the overall progress percentage. Finished children count as 100%.
+// Must be called with the Download lock held.
+func (g *group) aggregate() float32 {
+	if g.Total == 0 {
+		return 0
+	}
+	sum := float32(g.Completed+g.Failed+g.Cancelled) * 100
+	for _, p := range g.pct {
+		sum += p
+	}
+	return sum / float32(g.Total)
+}
@@ -0,0 +1,158 @@
+package ytworker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ErrURLNotAllowed is wrapped by the errors of [URLPolicy.Check].
+var ErrURLNotAllowed = errors.New("URL not allowed")
+
+// addresses that aren't covered by the [netip.Addr] methods but aren't on the public internet either
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// carrier-grade NAT, also used for cloud metadata services
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// URLPolicy restricts the URLs that can be downloaded. Only http and https URLs are allowed, and by
+// default hosts resolving to loopback, private, link-local or other non-public addresses are refused,
+// which includes cloud metadata services. yt-dlp then connects through a filtering proxy that refuses
+// them too, for redirects and the URLs yt-dlp finds itself.
+//
+// Domains match themselves and their subdomains. Extractors are yt-dlp extractor names or regexes,
+// see 'yt-dlp --list-extractors'. Deny lists take precedence over allow lists, empty allow lists allow everything.
+type URLPolicy struct {
+	AllowDomains    []string
+	DenyDomains     []string
+	AllowExtractors []string
+	DenyExtractors  []string
+	// AllowPrivate permits hosts with non-public addresses, e.g. a media server on the local network
+	AllowPrivate bool
+
+	resolver *net.Resolver
+	// proxy is started by [NewDownload] unless AllowPrivate is set
+	proxy *filteringProxy
+}
+
+// NewURLPolicy returns a policy from comma separated lists of domains and extractors.
+func NewURLPolicy(allowDomains, denyDomains, allowExtractors, denyExtractors string, allowPrivate bool) *URLPolicy {
+	return &URLPolicy{
+		AllowDomains:    splitList(strings.ToLower(allowDomains)),
+		DenyDomains:     splitList(strings.ToLower(denyDomains)),
+		AllowExtractors: splitList(strings.ToLower(allowExtractors)),
+		DenyExtractors:  splitList(strings.ToLower(denyExtractors)),
+		AllowPrivate:    allowPrivate,
+		resolver:        net.DefaultResolver,
+	}
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var list []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Check returns an error wrapping [ErrURLNotAllowed] if rawURL may not be downloaded.
+// Extractors can't be known before yt-dlp runs, they are enforced by yt-dlp itself, see [URLPolicy.args].
+// A nil URLPolicy only checks the scheme.
+func (p *URLPolicy) Check(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrURLNotAllowed, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: only http and https URLs can be downloaded", ErrURLNotAllowed)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("%w: URL has no host", ErrURLNotAllowed)
+	}
+	if p == nil {
+		return nil
+	}
+
+	if slices.ContainsFunc(p.DenyDomains, func(d string) bool { return matchDomain(host, d) }) {
+		return fmt.Errorf("%w: domain '%s' is blocked", ErrURLNotAllowed, host)
+	}
+	if len(p.AllowDomains) > 0 && !slices.ContainsFunc(p.AllowDomains, func(d string) bool { return matchDomain(host, d) }) {
+		return fmt.Errorf("%w: domain '%s' is not in the allowed list", ErrURLNotAllowed, host)
+	}
+
+	if p.AllowPrivate {
+		return nil
+	}
+	addrs, err := p.lookup(ctx, host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve '%s': %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return fmt.Errorf("%w: '%s' is not a public address", ErrURLNotAllowed, host)
+		}
+	}
+	return nil
+}
+
+// lookup returns the addresses of host, which may be an IP address itself.
+func (p *URLPolicy) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	return p.resolver.LookupNetIP(ctx, "ip", host)
+}
+
+// args returns the yt-dlp arguments that restrict the extractors it uses and the addresses it connects to.
+func (p *URLPolicy) args() []string {
+	if p == nil {
+		return nil
+	}
+	var args []string
+	if p.proxy != nil {
+		args = append(args, "--proxy", p.proxy.URL())
+	}
+	if len(p.AllowExtractors) == 0 && len(p.DenyExtractors) == 0 {
+		return args
+	}
+	names := slices.Clone(p.AllowExtractors)
+	if len(names) == 0 {
+		names = []string{"default"}
+	}
+	for _, e := range p.DenyExtractors {
+		names = append(names, "-"+e)
+	}
+	return append(args, "--use-extractors", strings.Join(names, ","))
+}
+
+// matchDomain reports whether host is domain or one of its subdomains.
+func matchDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// publicAddr reports whether addr is a unicast address on the public internet.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
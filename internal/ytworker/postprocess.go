@@ -0,0 +1,247 @@
+package ytworker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/command"
+	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/util"
+)
+
+// sample rate when neither the profile nor the source has one, or Opus can't encode it
+const defaultSampleRate = 48000
+
+// ffmpeg works on decoded audio, so a processed file has to be encoded again. These are
+// the encoders for the codecs of profiles, and for other files by their extension.
+var (
+	codecEncoders = map[string]string{
+		"aac":    "aac",
+		"m4a":    "aac",
+		"alac":   "alac",
+		"flac":   "flac",
+		"mp3":    "libmp3lame",
+		"opus":   "libopus",
+		"vorbis": "libvorbis",
+		"wav":    "pcm_s16le",
+	}
+	extEncoders = map[string]string{
+		".opus": "libopus",
+		".oga":  "libopus",
+		".webm": "libopus",
+		".mka":  "libopus",
+		".mkv":  "libopus",
+		".ogg":  "libvorbis",
+		".m4a":  "aac",
+		".mp4":  "aac",
+		".mp3":  "libmp3lame",
+		".flac": "flac",
+		".wav":  "pcm_s16le",
+	}
+
+	oggExts = map[string]bool{".opus": true, ".oga": true, ".ogg": true}
+
+	// sample rates libopus can encode
+	opusSampleRates = map[int]bool{8000: true, 12000: true, 16000: true, 24000: true, 48000: true}
+)
+
+// PostProcessing configures the optional ffmpeg steps run on a download once yt-dlp has finished.
+type PostProcessing struct {
+	FFmpegCmd string
+	Loudness  Loudness
+	Silence   Silence
+}
+
+// audioOutput describes the audio of a downloaded file, for encoding it again.
+type audioOutput struct {
+	// codec is the profile's codec, empty without a profile
+	codec string
+	// sampleRate in Hz and bitrate in kbit/s, zero if unknown
+	sampleRate int
+	bitrate    float64
+	// channels, zero to keep the source's
+	channels int
+	// duration in seconds, for reporting progress
+	duration float64
+	// reencode is set if the file has to be encoded again to match its profile, even without other steps
+	reencode bool
+}
+
+// postProcess applies the post-processing steps selected by the job's options and profile to the file at
+// filename, in place. Progress is reported to the job's sessions as the progress of info. The chapters of
+// info are written to the file with their processed timings. It returns the segments removed as silence,
+// so that the chapters and transcript can be moved.
+func (yt *Download) postProcess(ctx context.Context, j *jobs.Job, info Info, filename string, normalize bool, out audioOutput) ([]sponsorSegment, error) {
+	opts := j.Options
+	ext := filepath.Ext(filename)
+	encoder, ok := codecEncoders[out.codec]
+	if !ok {
+		encoder, ok = extEncoders[ext]
+	}
+	if !ok {
+		return nil, fmt.Errorf("post-processing doesn't support '%s' files", ext)
+	}
+
+	// the filters that change the audio, in both passes so that loudness is measured on the result
+	var filters, steps []string
+	if opts.TrimSilence {
+		filters = append(filters, yt.postProcessing.Silence.removeFilter())
+		steps = append(steps, "trimming silence")
+	}
+	if opts.Tempo > 0 && opts.Tempo != 1 {
+		filters = append(filters, tempoFilter(opts.Tempo))
+		steps = append(steps, fmt.Sprintf("changing tempo to %gx", opts.Tempo))
+		// progress is reported in output time
+		out.duration /= opts.Tempo
+	}
+	if normalize {
+		steps = append(steps, "normalizing loudness")
+	}
+	if len(steps) == 0 && out.reencode {
+		steps = append(steps, "encoding to the profile's format")
+	}
+	// silences have to be known before the file is written, to move its chapters
+	passes := 1
+	if normalize || opts.TrimSilence {
+		passes = 2
+	}
+
+	start := time.Now()
+	progress := func(pass int) func(string) {
+		msg := strings.Join(steps, ", ")
+		if passes > 1 {
+			msg += fmt.Sprintf(", pass %d of %d", pass, passes)
+		}
+		yt.send(j, util.Msg{Key: KeyUnknown, Value: Misc{Id: info.Id, Msg: msg + "\n"}})
+		return func(line string) {
+			// ffmpeg reports the position in microseconds, despite the name of out_time_ms
+			v, ok := strings.CutPrefix(line, "out_time_us=")
+			if !ok || out.duration <= 0 {
+				return
+			}
+			us, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return
+			}
+			share := float32(100 / passes)
+			pct := float32(min(float64(us)/1e6/out.duration, 1))*share + float32(pass-1)*share
+			var eta string
+			if pct > 0 {
+				eta = time.Duration(float32(time.Since(start)) / pct * (100 - pct)).Round(time.Second).String()
+			}
+			m := util.Msg{
+				Key: KeyInfo,
+				Value: Info{
+					Id:       info.Id,
+					Artist:   info.Artist,
+					Title:    info.Title,
+					FileSize: info.FileSize,
+					Video:    info.Video,
+					Progress: Progress{Pct: pct, FileSize: info.FileSize, ETA: eta},
+				},
+			}
+			yt.send(j, m)
+		}
+	}
+
+	ffmpeg := yt.postProcessing.FFmpegCmd
+	args := []string{"-hide_banner", "-nostdin", "-nostats", "-progress", "pipe:1", "-i", filename}
+	pass := 1
+
+	var silences []sponsorSegment
+	if passes > 1 {
+		// the first pass only analyses: silences are logged before they are removed, and
+		// loudness is measured on the result of the other filters
+		var analyse []string
+		if opts.TrimSilence {
+			analyse = append(analyse, yt.postProcessing.Silence.detectFilter())
+		}
+		analyse = append(analyse, filters...)
+		if normalize {
+			analyse = append(analyse, yt.postProcessing.Loudness.measureFilter())
+		}
+		analyseArgs := slices.Concat(args, []string{"-map", "0:a:0", "-af", strings.Join(analyse, ","), "-f", "null", "-"})
+		slog.Info("Running command", "command", append([]string{ffmpeg}, analyseArgs...))
+		stderr, err := command.RunCommandProgress(ctx, progress(pass), ffmpeg, analyseArgs...)
+		if err != nil {
+			return nil, ffmpegError("audio analysis", stderr, err)
+		}
+		if normalize {
+			stats, err := parseLoudnorm(stderr)
+			if err != nil {
+				return nil, err
+			}
+			slog.Info("loudness measured", "id", info.Id, "integrated", stats.InputI, "true_peak", stats.InputTP, "range", stats.InputLRA)
+			filters = append(filters, yt.postProcessing.Loudness.correctFilter(stats))
+		}
+		if opts.TrimSilence {
+			silences = parseSilences(stderr)
+		}
+		pass++
+	}
+
+	// the chapters copied from the input would keep the source timings, replace them
+	base := strings.TrimSuffix(filename, ext)
+	chaptersFile := base + ".chapters.txt"
+	chapters := processedChapters(info.Chapters, silences, opts.Tempo)
+	if len(chapters) > 0 {
+		if err := os.WriteFile(chaptersFile, ffmetadataChapters(chapters), 0o644); err != nil {
+			return nil, err
+		}
+		defer os.Remove(chaptersFile)
+		args = append(args, "-f", "ffmetadata", "-i", chaptersFile, "-map_metadata", "0", "-map_chapters", "1")
+	} else {
+		args = append(args, "-map_chapters", "-1")
+	}
+
+	// keep other streams such as video and cover art as they are
+	outFile := base + ".processed" + ext
+	// ffmpeg filters may resample, e.g. loudnorm to 192 kHz, go back to the source or profile rate
+	sampleRate := out.sampleRate
+	if sampleRate <= 0 || (encoder == "libopus" && !opusSampleRates[sampleRate]) {
+		sampleRate = defaultSampleRate
+	}
+	processArgs := slices.Concat(args, []string{"-y"})
+	if len(filters) > 0 {
+		processArgs = append(processArgs, "-af", strings.Join(filters, ","))
+	}
+	processArgs = append(processArgs, "-ar", strconv.Itoa(sampleRate))
+	if out.channels > 0 {
+		processArgs = append(processArgs, "-ac", strconv.Itoa(out.channels))
+	}
+	if oggExts[ext] {
+		// ffmpeg can't write cover art to Ogg, it's still served alongside the item
+		processArgs = append(processArgs, "-map", "0:a")
+	} else {
+		processArgs = append(processArgs, "-map", "0", "-c", "copy")
+	}
+	processArgs = append(processArgs, "-c:a", encoder)
+	if out.bitrate > 0 && encoder != "flac" && encoder != "alac" && encoder != "pcm_s16le" {
+		processArgs = append(processArgs, "-b:a", fmt.Sprintf("%.0fk", out.bitrate))
+	}
+	processArgs = append(processArgs, outFile)
+
+	slog.Info("Running command", "command", append([]string{ffmpeg}, processArgs...))
+	stderr, err := command.RunCommandProgress(ctx, progress(pass), ffmpeg, processArgs...)
+	if err != nil {
+		os.Remove(outFile)
+		return nil, ffmpegError(strings.Join(steps, ", "), stderr, err)
+	}
+	return silences, os.Rename(outFile, filename)
+}
+
+// ffmpegError returns err with the last line ffmpeg logged, which usually says what went wrong.
+func ffmpegError(what string, stderr []byte, err error) error {
+	lines := strings.Split(strings.TrimSpace(string(stderr)), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Errorf("%s failed: %s: %w", what, last, err)
+	}
+	return fmt.Errorf("%s failed: %w", what, err)
+}
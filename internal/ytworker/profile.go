@@ -0,0 +1,153 @@
+package ytworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Profile describes the audio output format of a download.
+//
+// Profiles are applied by yt-dlp's audio extraction. If the source is already in the profile's codec,
+// yt-dlp keeps it as-is, so when its bitrate, sample rate or channels differ it's encoded again by
+// the ffmpeg post-processing, see [Profile.reencode].
+type Profile struct {
+	// Codec is a yt-dlp audio format: aac, alac, flac, m4a, mp3, opus, vorbis or wav
+	Codec string
+	// Bitrate e.g. '32K'. Empty uses the encoder default.
+	Bitrate string `json:",omitempty"`
+	// SampleRate in Hz. Zero keeps the source sample rate.
+	SampleRate int `json:",omitempty"`
+	// Channels e.g. 1 for mono. Zero keeps the source channels.
+	Channels int `json:",omitempty"`
+	// Normalize applies loudness normalization to every download with the profile
+	Normalize bool `json:",omitempty"`
+}
+
+var (
+	// DefaultProfiles are available unless overridden by a profiles file.
+	DefaultProfiles = map[string]Profile{
+		"speech-32k-opus": {Codec: "opus", Bitrate: "32K", SampleRate: 24000, Channels: 1},
+		"music-128k-opus": {Codec: "opus", Bitrate: "128K", SampleRate: 48000, Channels: 2},
+		"compat-mp3-192k": {Codec: "mp3", Bitrate: "192K", SampleRate: 44100, Channels: 2},
+	}
+
+	profileCodecs = []string{"aac", "alac", "flac", "m4a", "mp3", "opus", "vorbis", "wav"}
+)
+
+// LoadProfiles returns the default profiles merged with those defined in the JSON file at path, if given.
+// The file holds an object of profiles keyed by name.
+func LoadProfiles(path string) (map[string]Profile, error) {
+	profiles := maps.Clone(DefaultProfiles)
+	if path == "" {
+		return profiles, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fromFile map[string]Profile
+	if err := json.Unmarshal(raw, &fromFile); err != nil {
+		return nil, fmt.Errorf("profiles file '%s': %w", path, err)
+	}
+	for name, p := range fromFile {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("profile '%s': %w", name, err)
+		}
+		profiles[name] = p
+	}
+
+	return profiles, nil
+}
+
+func (p Profile) validate() error {
+	if !slices.Contains(profileCodecs, p.Codec) {
+		return fmt.Errorf("unknown codec '%s'", p.Codec)
+	}
+	if p.SampleRate < 0 || p.Channels < 0 {
+		return fmt.Errorf("sample rate and channels must not be negative")
+	}
+	return nil
+}
+
+// sameCodec reports whether the yt-dlp acodec of a source, e.g. 'opus' or 'mp4a.40.2', is the profile's codec.
+// yt-dlp copies the audio instead of re-encoding it in that case.
+func (p Profile) sameCodec(acodec string) bool {
+	switch p.Codec {
+	case "aac", "m4a":
+		return acodec == "aac" || strings.HasPrefix(acodec, "mp4a")
+	default:
+		return acodec == p.Codec
+	}
+}
+
+// reencode reports whether a source in the profile's codec has to be encoded again, as its bitrate,
+// sample rate or channels differ from the profile. A bitrate within 10% counts as the same, an
+// unknown one as different.
+func (p Profile) reencode(ytInfo YTInfo) bool {
+	if !p.sameCodec(ytInfo.AudioCodec) {
+		// yt-dlp's audio extraction encodes it
+		return false
+	}
+	if b, err := parseBitrate(p.Bitrate); err == nil && (ytInfo.Bitrate <= 0 || math.Abs(ytInfo.Bitrate-b) > b/10) {
+		return true
+	}
+	if p.SampleRate > 0 && int(ytInfo.SampleRate) != p.SampleRate {
+		return true
+	}
+	return p.Channels > 0 && ytInfo.Channels != p.Channels
+}
+
+// parseBitrate returns a bitrate such as '32K' in kbit/s.
+func parseBitrate(bitrate string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(strings.ToUpper(bitrate), "K"), 64)
+}
+
+// embedsArtwork reports whether yt-dlp can embed cover art in the profile's output format.
+func (p Profile) embedsArtwork() bool {
+	switch p.Codec {
+	case "aac", "wav":
+		// raw ADTS and WAV files have no place for it
+		return false
+	default:
+		return true
+	}
+}
+
+// args returns the yt-dlp audio extraction arguments for the profile.
+func (p Profile) args() []string {
+	args := []string{"--audio-format", p.Codec}
+	if p.Bitrate != "" {
+		args = append(args, "--audio-quality", p.Bitrate)
+	}
+
+	var ffmpegArgs []string
+	if p.SampleRate > 0 {
+		ffmpegArgs = append(ffmpegArgs, "-ar", strconv.Itoa(p.SampleRate))
+	}
+	if p.Channels > 0 {
+		ffmpegArgs = append(ffmpegArgs, "-ac", strconv.Itoa(p.Channels))
+	}
+	if len(ffmpegArgs) > 0 {
+		args = append(args, "--postprocessor-args", "ExtractAudio:"+strings.Join(ffmpegArgs, " "))
+	}
+
+	return args
+}
+
+// Profile returns the named profile.
+func (yt *Download) Profile(name string) (Profile, bool) {
+	p, ok := yt.profiles[name]
+	return p, ok
+}
+
+// ProfileNames returns the names of the available profiles, sorted.
+func (yt *Download) ProfileNames() []string {
+	return slices.Sorted(maps.Keys(yt.profiles))
+}
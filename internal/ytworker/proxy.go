@@ -0,0 +1,191 @@
+package ytworker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// headers that apply to a single connection, and aren't forwarded by the proxy
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// filteringProxy is the HTTP proxy yt-dlp connects through when non-public addresses aren't allowed.
+// [URLPolicy.Check] only covers the submitted URL, yt-dlp goes on to follow redirects and fetch the
+// URLs it finds in pages. The proxy checks the address of every connection instead, and connects to
+// the address it checked, so that DNS can't give another one in between.
+type filteringProxy struct {
+	policy    *URLPolicy
+	listener  net.Listener
+	transport *http.Transport
+}
+
+// startProxy starts the policy's filtering proxy on a loopback port. It stops when ctx is done.
+func (p *URLPolicy) startProxy(ctx context.Context) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("filtering proxy: %w", err)
+	}
+	fp := &filteringProxy{policy: p, listener: ln}
+	fp.transport = &http.Transport{
+		DialContext:           fp.dial,
+		ForceAttemptHTTP2:     true,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	srv := &http.Server{Handler: fp, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("filtering proxy error", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("filtering proxy started", "address", ln.Addr().String())
+	p.proxy = fp
+	return nil
+}
+
+// URL returns the address yt-dlp is given as its proxy.
+func (fp *filteringProxy) URL() string {
+	return "http://" + fp.listener.Addr().String()
+}
+
+// dial connects to address if its host only resolves to public addresses.
+func (fp *filteringProxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := fp.policy.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			slog.Warn("filtering proxy refused connection", "host", host, "address", addr)
+			return nil, fmt.Errorf("%w: '%s' is not a public address", ErrURLNotAllowed, host)
+		}
+	}
+
+	var d net.Dialer
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (fp *filteringProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		fp.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || (r.URL.Scheme != "http" && r.URL.Scheme != "https") {
+		http.Error(w, "only proxy requests are accepted", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	// redirects are returned to yt-dlp, which follows them through the proxy again
+	resp, err := fp.transport.RoundTrip(out)
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Debug("filtering proxy copy error", "error", err)
+	}
+}
+
+// tunnel connects the client to the host of a CONNECT request, for https.
+func (fp *filteringProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	dst, err := fp.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		dst.Close()
+		http.Error(w, "tunnelling not supported", http.StatusInternalServerError)
+		return
+	}
+	src, buf, err := hj.Hijack()
+	if err != nil {
+		dst.Close()
+		slog.Error("filtering proxy hijack error", "error", err)
+		return
+	}
+	if _, err := src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		src.Close()
+		dst.Close()
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// the client may have sent data along with the request
+		io.Copy(dst, buf)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(src, dst)
+		if tcp, ok := src.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	wg.Wait()
+	src.Close()
+	dst.Close()
+}
+
+// proxyError answers a request the proxy couldn't pass on, 403 if it was refused.
+func proxyError(w http.ResponseWriter, err error) {
+	code := http.StatusBadGateway
+	if errors.Is(err, ErrURLNotAllowed) {
+		code = http.StatusForbidden
+	}
+	http.Error(w, err.Error(), code)
+}
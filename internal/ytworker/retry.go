@@ -0,0 +1,136 @@
+package ytworker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/util"
+)
+
+const KeyRetry = "retry"
+
+const (
+	DefaultMaxAttempts  = 3
+	DefaultRetryBackoff = 10 * time.Second
+
+	// number of yt-dlp error lines kept for the job's error message
+	maxErrorLines = 5
+)
+
+// yt-dlp errors worth another attempt: rate limiting, server errors and network trouble
+var ytTransientRe = regexp.MustCompile(`(?i)HTTP Error (429|5\d\d)|too many requests|timed? ?out|connection (reset|aborted|refused)|` +
+	`temporary failure in name resolution|network is unreachable|remote end closed|incomplete ?read|fragment|EOF occurred`)
+
+// RetryPolicy controls how often a failed download is attempted again.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, 1 disables retries
+	MaxAttempts int
+	// Backoff is the delay before the second attempt. It doubles for each attempt after that.
+	Backoff time.Duration
+}
+
+// delay returns how long to wait after the failed attempt, counting from 1.
+func (rp RetryPolicy) delay(attempt int) time.Duration {
+	return rp.Backoff << (attempt - 1)
+}
+
+// Retry is sent when a download failed and will be attempted again after Delay.
+type Retry struct {
+	Id          int64
+	Attempt     int
+	MaxAttempts int
+	Delay       string
+	// Msg is the error of the failed attempt
+	Msg string
+}
+
+// ytdlpError is returned when yt-dlp exits with an error. It carries the ERROR lines yt-dlp printed.
+type ytdlpError struct {
+	err   error
+	lines []string
+}
+
+func (e *ytdlpError) Error() string {
+	if len(e.lines) == 0 {
+		return e.err.Error()
+	}
+	return strings.Join(e.lines, "\n")
+}
+
+func (e *ytdlpError) Unwrap() error {
+	return e.err
+}
+
+// errorLines collects the ERROR lines of yt-dlp's output.
+type errorLines []string
+
+func (el *errorLines) note(line string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "ERROR:") {
+		return
+	}
+	*el = append(*el, line)
+	if len(*el) > maxErrorLines {
+		*el = (*el)[1:]
+	}
+}
+
+// wrap returns err with the collected lines, for errors reported by the yt-dlp command.
+func (el errorLines) wrap(err error) error {
+	return &ytdlpError{err: err, lines: el}
+}
+
+// transient reports whether err looks like a failure that may not happen again, judging by yt-dlp's output.
+func transient(err error) bool {
+	var ye *ytdlpError
+	if !errors.As(err, &ye) {
+		return false
+	}
+	for _, line := range ye.lines {
+		if ytTransientRe.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadWithRetry runs the download, attempting it again after transient failures with exponential
+// backoff. Each retry is reported to the job's sessions. Every attempt has its own process timeout.
+func (yt *Download) downloadWithRetry(ctx context.Context, j *jobs.Job, url *url.URL) error {
+	maxAttempts := max(yt.retry.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, yt.maxProcessTime)
+		err := yt.download(attemptCtx, j.ID, j, url)
+		cancel()
+		if err == nil || attempt >= maxAttempts || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+
+		delay := yt.retry.delay(attempt)
+		slog.Warn("download failed, retrying", "id", j.ID, "attempt", attempt, "delay", delay, "error", err)
+		m := util.Msg{
+			Key: KeyRetry,
+			Value: Retry{
+				Id:          j.ID,
+				Attempt:     attempt + 1,
+				MaxAttempts: maxAttempts,
+				Delay:       delay.String(),
+				Msg:         err.Error(),
+			},
+		}
+		yt.send(j, m)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("retry abandoned: %w", err)
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ytworker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultSilenceLevel is the level in dB below which audio counts as silence
+	DefaultSilenceLevel = -50.0
+	// DefaultSilenceMinDuration is the shortest silence that is removed
+	DefaultSilenceMinDuration = 2 * time.Second
+
+	// silence kept where a longer one was removed, so that sentences don't run into each other
+	silenceKept = 500 * time.Millisecond
+
+	// MinTempo and MaxTempo bound the tempo a file can be rendered at
+	MinTempo = 0.5
+	MaxTempo = 4.0
+)
+
+// silencedetect log lines, e.g. '[silencedetect @ 0x5581] silence_start: 12.5' and 'silence_end: 15.8 | silence_duration: 3.3'
+var (
+	silenceStartRe = regexp.MustCompile(`silence_start: (-?[\d.]+)`)
+	silenceEndRe   = regexp.MustCompile(`silence_end: ([\d.]+)`)
+)
+
+// Silence configures the removal of long silences.
+type Silence struct {
+	// Level in dB below which audio counts as silence
+	Level float64
+	// MinDuration is the shortest silence that is removed
+	MinDuration time.Duration
+}
+
+// detectFilter returns the filter that logs the silences that removeFilter removes, so that chapters can be moved.
+func (s Silence) detectFilter() string {
+	return fmt.Sprintf("silencedetect=noise=%gdB:duration=%g", s.Level, s.MinDuration.Seconds())
+}
+
+// removeFilter returns the filter that shortens every silence after the start of the audio that is at least
+// MinDuration long to silenceKept. The start is left alone, it's usually short.
+func (s Silence) removeFilter() string {
+	return fmt.Sprintf("silenceremove=stop_periods=-1:stop_duration=%g:stop_threshold=%gdB:stop_silence=%g:detection=peak",
+		s.MinDuration.Seconds(), s.Level, silenceKept.Seconds())
+}
+
+// tempoFilter returns the filter that speeds up or slows down audio without changing its pitch.
+func tempoFilter(tempo float64) string {
+	return fmt.Sprintf("atempo=%g", tempo)
+}
+
+// parseSilences returns the parts of silences removed by [Silence.removeFilter], from the log of [Silence.detectFilter].
+// They are returned as skipped segments, like those removed by SponsorBlock.
+func parseSilences(log []byte) []sponsorSegment {
+	var removed []sponsorSegment
+	start := -1.0
+	scanner := bufio.NewScanner(bytes.NewReader(log))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := silenceStartRe.FindStringSubmatch(line); m != nil {
+			start, _ = strconv.ParseFloat(m[1], 64)
+			continue
+		}
+		m := silenceEndRe.FindStringSubmatch(line)
+		if m == nil || start < 0 {
+			continue
+		}
+		end, _ := strconv.ParseFloat(m[1], 64)
+		// silence at the very start is kept, see removeFilter
+		if start > 0 && end-start > silenceKept.Seconds() {
+			removed = append(removed, sponsorSegment{StartTime: start + silenceKept.Seconds(), EndTime: end, Type: "skip"})
+		}
+		start = -1
+	}
+	return removed
+}
@@ -0,0 +1,136 @@
+package ytworker
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TranscriptExt is the extension of transcripts, which are always converted to WebVTT
+const TranscriptExt = ".vtt"
+
+// WebVTT timestamps, e.g. '01:02:03.456' or '02:03.456', in cue timings and karaoke style inline tags
+var (
+	cueTimingRe    = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}\.\d{3})\s+-->\s+((?:\d+:)?\d{2}:\d{2}\.\d{3})(.*)$`)
+	inlineTimingRe = regexp.MustCompile(`<((?:\d+:)?\d{2}:\d{2}\.\d{3})>`)
+)
+
+// subtitleArgs returns the yt-dlp arguments that fetch subtitles in the languages langs, or none
+// if langs is empty. Subtitles written by the uploader are preferred over generated ones.
+func subtitleArgs(langs []string) []string {
+	if len(langs) == 0 {
+		return nil
+	}
+	return []string{
+		"--write-subs",
+		"--write-auto-subs",
+		"--sub-langs", strings.Join(langs, ","),
+		"--convert-subs", "vtt",
+	}
+}
+
+// TranscriptFile returns the path of the transcript of the library item at filename. It is a hidden
+// file next to the item, so it isn't listed as an item itself.
+func TranscriptFile(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+TranscriptExt)
+}
+
+// moveTranscript moves the subtitles written alongside the temporary file in the first of langs
+// that has any to the item at filename, and removes the others. langs are yt-dlp language codes or regexes.
+func moveTranscript(tmpFileName, filename string, langs []string) error {
+	files, err := filepath.Glob(tmpFileName + ".*" + TranscriptExt)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	best := ""
+	for _, lang := range langs {
+		re, err := regexp.Compile("^(?:" + lang + ")$")
+		if err != nil {
+			return fmt.Errorf("subtitle language '%s': %w", lang, err)
+		}
+		for _, f := range files {
+			// the language is between the temporary file name and the extension
+			if re.MatchString(strings.TrimSuffix(strings.TrimPrefix(f, tmpFileName+"."), TranscriptExt)) {
+				best = f
+				break
+			}
+		}
+		if best != "" {
+			break
+		}
+	}
+	if best == "" {
+		best = files[0]
+	}
+
+	for _, f := range files {
+		if f == best {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			slog.Error("subtitle remove error", "file", f, "error", err)
+		}
+	}
+	return os.Rename(best, TranscriptFile(filename))
+}
+
+// retimeTranscript moves the cues of the transcript at filename to match its item after post-processing
+// removed silences and rendered it at tempo, zero for unchanged. Cues spoken entirely during a removed
+// silence are dropped.
+func retimeTranscript(filename string, silences []sponsorSegment, tempo float64) error {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	retime := func(ts string) string {
+		return vttTimestamp(processedTime(parseVTTTimestamp(ts), silences, tempo))
+	}
+
+	blocks := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n\n")
+	out := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		lines := strings.Split(block, "\n")
+		dropped := false
+		for i, line := range lines {
+			m := cueTimingRe.FindStringSubmatch(line)
+			if m == nil {
+				lines[i] = inlineTimingRe.ReplaceAllStringFunc(line, func(tag string) string {
+					return "<" + retime(tag[1:len(tag)-1]) + ">"
+				})
+				continue
+			}
+			start, end := retime(m[1]), retime(m[2])
+			if start == end {
+				dropped = true
+				break
+			}
+			lines[i] = start + " --> " + end + m[3]
+		}
+		if !dropped {
+			out = append(out, strings.Join(lines, "\n"))
+		}
+	}
+	return os.WriteFile(filename, []byte(strings.Join(out, "\n\n")), 0o644)
+}
+
+// parseVTTTimestamp returns a WebVTT timestamp in seconds.
+func parseVTTTimestamp(ts string) float64 {
+	var secs float64
+	for part := range strings.SplitSeq(ts, ":") {
+		v, _ := strconv.ParseFloat(part, 64)
+		secs = secs*60 + v
+	}
+	return secs
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp.
+func vttTimestamp(secs float64) string {
+	ms := int64(math.Round(max(secs, 0) * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/ytworker"
+)
+
+const (
+	// per-user library directories, relative to the output path
+	usersDir = "users"
+	// library of items published to everyone, relative to the output path
+	sharedDir = "shared"
+)
+
+// user names that can be used as directory names as they are
+var safeUserRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// libraries maps users to their library directories. Without authentication there is a single
+// library in the output path itself, otherwise each user has their own under [usersDir].
+type libraries struct {
+	outPath string
+	// shared enables the library in [sharedDir]
+	shared bool
+
+	expiry       time.Duration
+	sharedExpiry time.Duration
+	// expiry of user libraries that differ from the default, keyed by library directory
+	userExpiry map[string]time.Duration
+}
+
+// newLibraries returns the libraries in outPath. userExpiry optionally lists per-user content expiry
+// as comma separated user=duration pairs, e.g. 'alice=48h,bob=30m'.
+func newLibraries(outPath string, shared bool, expiry, sharedExpiry time.Duration, userExpiry string) (*libraries, error) {
+	l := &libraries{
+		outPath:      strings.Trim(outPath, "/"),
+		shared:       shared,
+		expiry:       expiry,
+		sharedExpiry: sharedExpiry,
+		userExpiry:   make(map[string]time.Duration),
+	}
+	if userExpiry == "" {
+		return l, nil
+	}
+	for pair := range strings.SplitSeq(userExpiry, ",") {
+		user, d, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("user expiry '%s' is not user=duration", pair)
+		}
+		expiry, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("user expiry '%s': %w", pair, err)
+		}
+		l.userExpiry[l.Dir(user)] = expiry
+	}
+	return l, nil
+}
+
+// Dir returns the library directory of user, relative to the output path.
+func (l *libraries) Dir(user string) string {
+	if user == "" {
+		return ""
+	}
+	if !safeUserRe.MatchString(user) {
+		// '~' can't appear in a safe name, so encoded names don't collide with them
+		user = "~" + hex.EncodeToString([]byte(user))
+	}
+	return path.Join(usersDir, user)
+}
+
+// Topic returns the SSE topic for messages about the library dir, such as its list of recent items.
+func (l *libraries) Topic(dir string) string {
+	return "lib:" + dir
+}
+
+// Expiry returns how long files are kept in the library dir.
+func (l *libraries) Expiry(dir string) time.Duration {
+	if dir == sharedDir {
+		return l.sharedExpiry
+	}
+	if e, ok := l.userExpiry[dir]; ok {
+		return e
+	}
+	return l.expiry
+}
+
+// libraryOf returns the library directory of the file at url, which is relative to the web root.
+// ok is false if url is not a file directly within a library.
+func (l *libraries) libraryOf(url string) (dir string, ok bool) {
+	rel, ok := strings.CutPrefix(path.Clean("/"+url), "/"+l.outPath+"/")
+	if !ok {
+		return "", false
+	}
+	dir = path.Dir(rel)
+	if dir == "." {
+		dir = ""
+	}
+	switch {
+	case dir == "", dir == sharedDir && l.shared:
+	case path.Dir(dir) == usersDir:
+	default:
+		return "", false
+	}
+	return dir, true
+}
+
+// Guard wraps the file server so that users can only fetch files in their own library and the shared library.
+func (l *libraries) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		if rel, ok := strings.CutPrefix(p, "/"+path.Join(l.outPath, usersDir)+"/"); ok {
+			own := l.Dir(userFromContext(r.Context()))
+			if own == "" || !strings.HasPrefix(path.Join(usersDir, rel)+"/", own+"/") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GuardTmp wraps handlers of the temporary directory, directly or as streams, so that users can only fetch
+// the temporary files of their own downloads. library returns the library the temporary file named name is
+// downloaded to.
+func (l *libraries) GuardTmp(library func(name string) (string, bool), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// streams have the same paths with 'stream/' inserted, see ServeStream
+		p := strings.Replace(path.Clean("/"+r.URL.Path), "stream/", "", 1)
+		if path.Dir(p) == "/"+path.Join(l.outPath, ytworker.TmpDir) {
+			lib, ok := library(path.Base(p))
+			if !ok || lib != l.Dir(userFromContext(r.Context())) {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fullPath returns the path of library dir on disk.
+func (l *libraries) fullPath(webRoot, dir string) string {
+	return filepath.Join(webRoot, l.outPath, filepath.FromSlash(dir))
+}
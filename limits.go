@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/metrics"
+)
+
+// how long a client waits before retrying when its queue is full
+const QueueFullRetryAfter = 30 * time.Second
+
+// limitError rejects a request that is over a per-client limit. It is answered with
+// 429 Too Many Requests and a Retry-After header.
+type limitError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// clientLimits caps the download requests of each client: how many it may make per minute
+// and how many of its jobs may be waiting in the queue. The number of jobs of a client running
+// at once is limited by the dispatcher. Zero disables a limit.
+type clientLimits struct {
+	perMinute  int
+	maxQueued  int
+	dispatcher *jobs.Dispatcher
+
+	mu sync.Mutex
+	// times of each client's requests within the last minute, oldest first
+	requests map[string][]time.Time
+}
+
+func newClientLimits(perMinute, maxQueued int, dispatcher *jobs.Dispatcher) *clientLimits {
+	return &clientLimits{
+		perMinute:  perMinute,
+		maxQueued:  maxQueued,
+		dispatcher: dispatcher,
+		requests:   make(map[string][]time.Time),
+	}
+}
+
+// clientID returns the client a request counts against: the authenticated user,
+// otherwise the remote address without its port.
+func clientID(r *http.Request) string {
+	if user := userFromContext(r.Context()); user != "" {
+		return "user:" + user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Allow counts a download request of client, or returns a [limitError] if the client
+// has made too many in the last minute.
+func (cl *clientLimits) Allow(client string) error {
+	if cl.perMinute <= 0 {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	now := time.Now()
+	for c, times := range cl.requests {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) >= time.Minute {
+			i++
+		}
+		if i == len(times) {
+			delete(cl.requests, c)
+		} else {
+			cl.requests[c] = times[i:]
+		}
+	}
+
+	times := cl.requests[client]
+	if len(times) >= cl.perMinute {
+		metrics.RejectedRequests.WithLabelValues("rate").Inc()
+		return &limitError{
+			msg:        fmt.Sprintf("too many requests, the limit is %d per minute", cl.perMinute),
+			retryAfter: time.Minute - now.Sub(times[0]),
+		}
+	}
+	cl.requests[client] = append(times, now)
+	return nil
+}
+
+// CheckQueue returns a [limitError] if adding n jobs would take client over its queue limit.
+func (cl *clientLimits) CheckQueue(client string, n int) error {
+	if cl.maxQueued <= 0 {
+		return nil
+	}
+	queued, _ := cl.dispatcher.ClientJobs(client)
+	if queued+n <= cl.maxQueued {
+		return nil
+	}
+	metrics.RejectedRequests.WithLabelValues("queue").Inc()
+	msg := fmt.Sprintf("too many queued downloads, the limit is %d", cl.maxQueued)
+	if n > 1 {
+		msg = fmt.Sprintf("%d downloads don't fit in the queue, %d of %d queued", n, queued, cl.maxQueued)
+	}
+	return &limitError{msg: msg, retryAfter: QueueFullRetryAfter}
+}
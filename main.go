@@ -5,17 +5,21 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/porjo/ytdl-web/internal/jobs"
-	"github.com/porjo/ytdl-web/internal/util"
+	"github.com/porjo/ytdl-web/internal/metrics"
 	"github.com/porjo/ytdl-web/internal/ytworker"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	sse "github.com/tmaxmax/go-sse"
 )
 
@@ -27,16 +31,49 @@ func main() {
 
 	ytCmd := flag.String("cmd", "/usr/bin/yt-dlp", "path to yt-dlp")
 	ffprobeCmd := flag.String("ffprobe", "/usr/bin/ffprobe", "path to ffprobe")
+	ffmpegCmd := flag.String("ffmpeg", "/usr/bin/ffmpeg", "path to ffmpeg, for loudness normalization, silence trimming and tempo changes")
+	loudnessTarget := flag.Float64("loudnessTarget", ytworker.DefaultLoudnessTarget, "integrated loudness (LUFS) of normalized downloads")
+	truePeak := flag.Float64("truePeak", ytworker.DefaultTruePeak, "true peak limit (dBTP) of normalized downloads")
+	silenceLevel := flag.Float64("silenceLevel", ytworker.DefaultSilenceLevel, "level (dB) below which audio counts as silence when trimming silence")
+	silenceMin := flag.Duration("silenceMin", ytworker.DefaultSilenceMinDuration, "shortest silence removed when trimming silence")
 	sponsorBlock := flag.Bool("sponsorBlock", false, "enable SponsorBlock ad removal")
 	sponsorBlockCats := flag.String("sponsorBlockCategories", "sponsor", "set SponsorBlock categories (comma separated)")
 	webRoot := flag.String("webRoot", "html", "web root directory")
 	outPath := flag.String("outPath", "dl", "where to store downloaded files (relative to web root)")
+	dataDir := flag.String("dataDir", "data", "where to store the job journal, metadata index and other state, outside the web root")
 	maxProcessTime := flag.Duration("timeout", MaxProcessTime, "maximum processing time")
+	allowDomains := flag.String("allowDomains", "", "only download from these domains and their subdomains (comma separated)")
+	denyDomains := flag.String("denyDomains", "", "never download from these domains and their subdomains (comma separated)")
+	allowExtractors := flag.String("allowExtractors", "", "only use these yt-dlp extractors (comma separated), e.g. youtube,soundcloud")
+	denyExtractors := flag.String("denyExtractors", "", "never use these yt-dlp extractors (comma separated), e.g. generic")
+	allowPrivate := flag.Bool("allowPrivate", false, "allow downloading from loopback, private and link-local addresses")
+	profilesFile := flag.String("profiles", "", "JSON file of audio output profiles, in addition to the built-in profiles")
+	attempts := flag.Int("attempts", ytworker.DefaultMaxAttempts, "maximum attempts of a download that fails with a network error, HTTP 429 or similar")
+	retryBackoff := flag.Duration("retryBackoff", ytworker.DefaultRetryBackoff, "delay before retrying a failed download, doubled for each further attempt")
+	subLangs := flag.String("subLangs", "", "download subtitles in these languages as transcripts (comma separated, in order of preference), e.g. en,en-.*. Disabled if not set")
+	videoMaxHeight := flag.Int("videoMaxHeight", ytworker.DefaultVideoMaxHeight, "maximum video height (pixels) in video mode")
 	expiry := flag.Duration("expiry", DefaultExpiry, "expire downloaded content")
+	quotaSize := flag.String("quota", "", "maximum total size of the libraries, e.g. 20G. The least recently used files are evicted to make room for new downloads")
+	userExpiry := flag.String("userExpiry", "", "expire content of specific users' libraries, as comma separated user=duration pairs, e.g. alice=48h,bob=30m")
+	shared := flag.Bool("shared", false, "enable the shared library that users can publish downloads to")
+	sharedExpiry := flag.Duration("sharedExpiry", DefaultExpiry, "expire content of the shared library")
+	rateLimit := flag.Int("rateLimit", 0, "maximum download requests per minute from a single client (user or remote address), 0 for no limit")
+	maxQueued := flag.Int("maxQueued", 0, "maximum queued downloads of a single client, 0 for no limit")
+	maxRunning := flag.Int("maxRunning", 0, "maximum downloads of a single client running at once, 0 for no limit")
 	port := flag.Int("port", 8080, "listen on this port")
+	authFile := flag.String("auth", "", "JSON file of API tokens, users and trusted proxy header. Authentication is disabled if not set")
+	hashPassword := flag.Bool("hashPassword", false, "read a password from stdin, print its hash for the auth file and exit")
 	debug := flag.Bool("debug", false, "debug logging")
 	flag.Parse()
 
+	if *hashPassword {
+		if err := HashPassword(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// setup logging
 	programLevel := new(slog.LevelVar) // Info by default
 	so := &slog.HandlerOptions{Level: programLevel}
@@ -53,37 +90,127 @@ func main() {
 	slog.Info("set web root", "webroot", *webRoot)
 	slog.Info("set process timeout", "timeout", *maxProcessTime)
 	slog.Info("set output path", "output_path", outPathFull)
+	slog.Info("set data directory", "data_dir", *dataDir)
 	slog.Info("set content expiry", "expiry", *expiry)
 
-	err := mime.AddExtensionType(".oga", "audio/ogg")
+	// the builtin MIME table doesn't cover audio, and the system table may be missing
+	for ext, typ := range map[string]string{
+		".oga":  "audio/ogg",
+		".opus": "audio/ogg",
+		".m4a":  "audio/mp4",
+		".mp3":  "audio/mpeg",
+		".mp4":  "video/mp4",
+		".webm": "video/webm",
+	} {
+		err := mime.AddExtensionType(ext, typ)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var auth *Auth
+	if *authFile != "" {
+		// API, library and streams need a user, the static files of the web UI are public
+		protected := []string{"/dl", "/" + strings.Trim(*outPath, "/"), "/sse", "/recent", "/jobs", "/profiles", "/feed.xml", "/positions", "/metrics"}
+		var err error
+		auth, err = LoadAuth(*authFile, protected, logger)
+		if err != nil {
+			slog.Error("unable to load auth config", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("authentication enabled")
+	}
+
+	libs, err := newLibraries(*outPath, *shared, *expiry, *sharedExpiry, *userExpiry)
 	if err != nil {
-		slog.Error(err.Error())
+		slog.Error("invalid library settings", "error", err)
+		os.Exit(1)
+	}
+
+	policy := ytworker.NewURLPolicy(*allowDomains, *denyDomains, *allowExtractors, *denyExtractors, *allowPrivate)
+
+	profiles, err := ytworker.LoadProfiles(*profilesFile)
+	if err != nil {
+		slog.Error("unable to load profiles", "error", err)
 		os.Exit(1)
 	}
 
+	metadataFile, err := stateFile(*dataDir, *webRoot, outPathFull, MetadataFile)
+	if err != nil {
+		slog.Error("unable to open metadata index", "error", err)
+		os.Exit(1)
+	}
+	index, err := openMetadataIndex(metadataFile, *ffprobeCmd)
+	if err != nil {
+		slog.Error("unable to open metadata index", "error", err)
+		os.Exit(1)
+	}
+
+	var q *quota
+	var storage ytworker.Storage
+	if *quotaSize != "" {
+		limit, err := parseSize(*quotaSize)
+		if err != nil {
+			slog.Error("invalid quota", "error", err)
+			os.Exit(1)
+		}
+		q = newQuota(limit, outPathFull, index)
+		storage = q
+		slog.Info("library quota enabled", "bytes", limit)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	dl, err := ytworker.NewDownload(ctx, *webRoot, *outPath, *sponsorBlock, *sponsorBlockCats, *ytCmd, *maxProcessTime)
+	dl, err := ytworker.NewDownload(ctx, *webRoot, *outPath, *sponsorBlock, *sponsorBlockCats, *ytCmd, *maxProcessTime, *videoMaxHeight, profiles, policy, storage, ytworker.RetryPolicy{MaxAttempts: *attempts, Backoff: *retryBackoff}, *subLangs,
+		ytworker.PostProcessing{
+			FFmpegCmd: *ffmpegCmd,
+			Loudness:  ytworker.Loudness{Target: *loudnessTarget, TruePeak: *truePeak},
+			Silence:   ytworker.Silence{Level: *silenceLevel, MinDuration: *silenceMin},
+		})
 	if err != nil {
 		slog.Error(err.Error())
 	}
-	dispatcher := jobs.NewDispatcher(dl, 10)
+	journalFile, err := stateFile(*dataDir, *webRoot, outPathFull, JournalFile)
+	if err != nil {
+		slog.Error("unable to open job journal", "error", err)
+		os.Exit(1)
+	}
+	journal, err := jobs.OpenJournal(journalFile)
+	if err != nil {
+		slog.Error("unable to open job journal", "error", err)
+		os.Exit(1)
+	}
+
+	dispatcher := jobs.NewDispatcher(dl, 10, *maxRunning, journal)
 	go func() {
 		slog.Info("starting job dispatcher")
 		dispatcher.Start(ctx)
 	}()
 
+	// replay missed messages to reconnecting clients, or show new ones the jobs in progress
+	replayer := newTopicReplayer(SSEReplaySize, SSEReplayExpiry, func(topics []string) []*sse.Message {
+		return jobSnapshot(journal, topics)
+	})
+
 	s := &sse.Server{
+		Provider: &sse.Joe{Replayer: replayer},
 		OnSession: func(w http.ResponseWriter, r *http.Request) (topics []string, accepted bool) {
-			logger.Debug("sse session started", "remote_addr", r.RemoteAddr)
+			session := sessionID(w, r)
+			library := libs.Dir(userFromContext(r.Context()))
+			logger.Debug("sse session started", "remote_addr", r.RemoteAddr, "session", session, "library", library)
+			metrics.SSESessions.Inc()
 
 			// session ends when request ends
 			go func() {
 				<-r.Context().Done()
-				logger.Debug("sse session ended", "remote_addr", r.RemoteAddr)
+				metrics.SSESessions.Dec()
+				logger.Debug("sse session ended", "remote_addr", r.RemoteAddr, "session", session)
 			}()
 
-			return []string{sse.DefaultTopic}, true
+			// job messages go to the session topic, the user's library listing to the library topic
+			// and messages for everyone, such as the shared library, to the default topic
+			return []string{sse.DefaultTopic, session, libs.Topic(library)}, true
 		},
 	}
 
@@ -122,6 +249,32 @@ func main() {
 					return
 				}
 
+				// keep the job records up to date for clients polling /jobs
+				switch m.Key {
+				case ytworker.KeyInfo:
+					if info, ok := m.Value.(ytworker.Info); ok {
+						journal.Progress(info.Id, info.Title, info.Progress.Pct, info.Progress.ETA)
+					}
+				case ytworker.KeyPostProcessing:
+					if misc, ok := m.Value.(ytworker.Misc); ok {
+						if err := journal.PostProcessing(misc.Id); err != nil {
+							logger.Error("journal update error", "error", err)
+						}
+					}
+				case ytworker.KeyRetry:
+					if retry, ok := m.Value.(ytworker.Retry); ok {
+						if err := journal.Retry(retry.Id, retry.Attempt, retry.Msg); err != nil {
+							logger.Error("journal update error", "error", err)
+						}
+					}
+				case ytworker.KeyCompleted:
+					if info, ok := m.Value.(ytworker.Info); ok {
+						if err := journal.Result(info.Id, info.Title, info.DownloadURL); err != nil {
+							logger.Error("journal update error", "error", err)
+						}
+					}
+				}
+
 				// ratelimit info updates to prevent flooding client
 				if m.Key == ytworker.KeyInfo {
 					if time.Since(lastInfo) < time.Millisecond*500 {
@@ -134,66 +287,88 @@ func main() {
 				j, _ := m.JSON()
 				sseM.AppendData(string(j))
 
-				if m.Key == ytworker.KeyCompleted {
-					// on completion, also send recent URLs
-					gruCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-					defer cancel()
-					recentURLs, err := GetRecentURLs(gruCtx, *webRoot, *outPath, *ffprobeCmd)
-					if err != nil {
-						logger.Error("GetRecentURLS error", "error", err)
-						continue
-					}
-					m := util.Msg{Key: "recent", Value: recentURLs}
-					j, _ = m.JSON()
-					logger.Debug("recent", "json", string(j))
-					sseM.AppendData(string(j))
-				}
-				err = s.Publish(sseM)
+				// job messages only go to the session that submitted the job
+				err = s.Publish(sseM, m.Topics...)
 				if err != nil {
 					logger.Error("SSE publish error", "error", err)
 					continue
 				}
+
+				if info, ok := m.Value.(ytworker.Info); ok && m.Key == ytworker.KeyCompleted {
+					gruCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+					err := index.Update(gruCtx, filepath.Join(*webRoot, info.DownloadURL), info)
+					if err != nil {
+						logger.Error("metadata index update error", "error", err)
+					}
+
+					// on completion, also send recent URLs to the users of the library
+					if library, ok := libs.libraryOf(filepath.ToSlash(info.DownloadURL)); ok {
+						err = publishRecent(gruCtx, s, *webRoot, libs, library, index)
+						if err != nil {
+							logger.Error("publish recent error", "error", err)
+						}
+					}
+					cancel()
+				}
 			}
 		}
 	}()
 
+	// resume jobs that were interrupted by the last shutdown, now that their messages are read from OutCh
+	for _, job := range journal.Unfinished() {
+		slog.Info("resuming job", "id", job.ID, "url", job.Payload)
+		dispatcher.Enqueue(job)
+		dl.Queued(job)
+	}
+
 	dlh := &dlHandler{
 		WebRoot:    *webRoot,
 		OutPath:    *outPath,
 		FFProbeCmd: *ffprobeCmd,
 		Dispatcher: dispatcher,
 		Downloader: dl,
+		Journal:    journal,
+		Index:      index,
+		Libraries:  libs,
+		Limits:     newClientLimits(*rateLimit, *maxQueued, dispatcher),
 		Logger:     logger,
 		SSE:        s,
 	}
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/dl/stream/", ServeStream(*webRoot))
-	mux.Handle("/", http.FileServer(http.Dir(*webRoot)))
+	// temporary files are only served to the user downloading them, or once finished to the users of their library
+	tmpLibrary := func(name string) (string, bool) {
+		if lib, ok := dl.TmpLibrary(name); ok {
+			return lib, true
+		}
+		if final, ok := dl.CompletedStream(path.Join(*outPath, ytworker.TmpDir, name)); ok {
+			return libs.libraryOf(filepath.ToSlash(final))
+		}
+		return "", false
+	}
+	mux.Handle("/dl/stream/", libs.GuardTmp(tmpLibrary, ServeStream(*webRoot, dl)))
+	mux.Handle("/", libs.GuardTmp(tmpLibrary, libs.Guard(trackPlays(*webRoot, *outPath, index, serveChapters(*webRoot, *outPath, index, serveTranscript(*webRoot, *outPath, http.FileServer(http.Dir(*webRoot))))))))
 
-	mux.Handle("/sse", s)
+	mux.Handle("/sse", lastEventIDParam(s))
 	mux.Handle("/dl", dlh)
+	mux.HandleFunc("DELETE /dl/{id}", dlh.CancelHandler)
+	mux.HandleFunc("GET /jobs", dlh.JobsHandler)
+	mux.HandleFunc("GET /jobs/{id}", dlh.JobHandler)
+	mux.HandleFunc("GET /profiles", dlh.ProfilesHandler)
+	mux.HandleFunc("POST /login", auth.LoginHandler)
+	mux.HandleFunc("POST /logout", auth.LogoutHandler)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /feed.xml", FeedHandler(*webRoot, libs, index))
+	mux.HandleFunc("GET /positions", PositionsHandler(libs, index))
+	mux.HandleFunc("GET /positions/{id}", PositionHandler(*webRoot, libs, index))
+	mux.HandleFunc("PUT /positions/{id}", UpdatePositionHandler(*webRoot, libs, index))
 	mux.Handle("/recent", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		recentURLs, err := GetRecentURLs(r.Context(), *webRoot, *outPath, *ffprobeCmd)
-		if err != nil {
-			logger.Error("GetRecentURLS error", "error", err)
-			return
-		}
-		slog.Debug("getting recent urls", "url_count", len(recentURLs))
-		m := util.Msg{Key: "recent", Value: recentURLs}
-		j, _ := m.JSON()
-		sseM := &sse.Message{}
-		sseM.AppendData(string(j))
-		err = s.Publish(sseM)
-		if err != nil {
-			logger.Error("SSE publish error", "error", err)
-			return
-		}
+		dlh.publishLibraries(r.Context(), userFromContext(r.Context()))
 	}))
 
 	slog.Info("starting cleanup routine...")
-	go fileCleanup(filepath.Join(*webRoot, *outPath), *expiry)
+	go fileCleanup(filepath.Join(*webRoot, *outPath), libs, index, q)
 
 	slog.Info("listening on port", "port", *port)
 
@@ -201,7 +376,7 @@ func main() {
 		Addr:         fmt.Sprintf(":%d", *port),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: HTTPWriteTimeout,
-		Handler:      mux,
+		Handler:      auth.Middleware(mux),
 	}
 	srv.Protocols = new(http.Protocols)
 	srv.Protocols.SetHTTP1(true)
@@ -230,8 +405,44 @@ func main() {
 		}
 	}
 
+	// keep the play times and positions recorded since the last save
+	if err := index.Save(); err != nil {
+		slog.Error("metadata index save error", "error", err)
+	}
+
 	// wait a bit for things to settle
 	time.Sleep(time.Second)
 
 	slog.Info("Exiting")
 }
+
+// stateFile returns the path of the state file name in dataDir, which must be outside the web root
+// so that the file server doesn't serve it. A file left in outPath by an earlier version, where it
+// was hidden by a leading dot, is moved there.
+func stateFile(dataDir, webRoot, outPath, name string) (string, error) {
+	absData, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", err
+	}
+	absRoot, err := filepath.Abs(webRoot)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(absRoot, absData); err == nil && !strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("data directory '%s' is within the web root '%s'", dataDir, webRoot)
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(dataDir, name)
+	legacy := filepath.Join(outPath, "."+name)
+	if _, err := os.Stat(filename); errors.Is(err, fs.ErrNotExist) {
+		if err := os.Rename(legacy, filename); err == nil {
+			slog.Info("state file moved out of the web root", "from", legacy, "to", filename)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return filename, nil
+}
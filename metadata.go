@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/util"
+	"github.com/porjo/ytdl-web/internal/ytworker"
+)
+
+// metadataVersion is stored with each entry. Increment it when the ffprobe struct changes
+// so that entries are probed again.
+const metadataVersion = 2
+
+// metadataIndex caches ffprobe results for files in the output directory, so that files
+// are only probed when they are new or have changed. The index is persisted to disk.
+type metadataIndex struct {
+	mu         sync.Mutex
+	path       string
+	ffprobeCmd string
+	entries    map[string]*metadataEntry // keyed by file path
+	dirty      bool
+}
+
+type metadataEntry struct {
+	// ID identifies the item in the API, it stays the same when the file is published
+	ID      string `json:",omitempty"`
+	Version int
+	Size    int64
+	ModTime time.Time
+	Probe   *ffprobe
+	// Source identifies the request that produced the file, see [ytworker.JobKey]
+	Source string `json:",omitempty"`
+	// Owner is the user that published the file to the shared library
+	Owner string `json:",omitempty"`
+	// Pinned files are never evicted or expired
+	Pinned bool `json:",omitempty"`
+	// Played is when the file was last fetched
+	Played time.Time `json:",omitzero"`
+	// Chapters are read from the yt-dlp info file when the file is downloaded
+	Chapters []ytworker.Chapter `json:",omitempty"`
+	// Tempo and SilenceTrimmed record the post-processing of the file
+	Tempo          float64 `json:",omitempty"`
+	SilenceTrimmed bool    `json:",omitempty"`
+	// Positions are where users stopped listening, keyed by their library directory
+	Positions map[string]*position `json:",omitempty"`
+}
+
+// position is where a user stopped listening to an item
+type position struct {
+	// Position and Duration in seconds
+	Position     float64
+	Duration     float64
+	PlaybackRate float64
+	LastPlayed   time.Time
+}
+
+// openMetadataIndex loads the index stored at path, creating it if it doesn't exist.
+func openMetadataIndex(path, ffprobeCmd string) (*metadataIndex, error) {
+	mi := &metadataIndex{
+		path:       path,
+		ffprobeCmd: ffprobeCmd,
+		entries:    make(map[string]*metadataEntry),
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return mi, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &mi.entries); err != nil {
+		// the index is only a cache, start again
+		slog.Warn("metadata index unreadable, rebuilding", "path", path, "error", err)
+		mi.entries = make(map[string]*metadataEntry)
+	}
+
+	return mi, nil
+}
+
+// Get returns the ffprobe result for the file at filename, running ffprobe only if the
+// file's size or modification time differ from the cached entry.
+func (mi *metadataIndex) Get(ctx context.Context, filename string, fi fs.FileInfo) (*ffprobe, error) {
+	mi.mu.Lock()
+	e, ok := mi.entries[filename]
+	mi.mu.Unlock()
+	if ok && e.Version == metadataVersion && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) {
+		return e.Probe, nil
+	}
+
+	ff, err := runFFprobe(ctx, mi.ffprobeCmd, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	mi.mu.Lock()
+	ne := &metadataEntry{}
+	if e, ok := mi.entries[filename]; ok {
+		// keep what isn't derived from the file itself
+		*ne = *e
+	}
+	ne.Version = metadataVersion
+	ne.Size = fi.Size()
+	ne.ModTime = fi.ModTime()
+	ne.Probe = ff
+	mi.entries[filename] = ne
+	mi.dirty = true
+	mi.mu.Unlock()
+
+	return ff, nil
+}
+
+// Update probes the file at filename and stores the result along with the download's info,
+// e.g. when a download is renamed into place.
+func (mi *metadataIndex) Update(ctx context.Context, filename string, info ytworker.Info) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	_, err = mi.Get(ctx, filename, fi)
+	if err != nil {
+		return err
+	}
+
+	mi.mu.Lock()
+	e := mi.entries[filename]
+	e.Source = info.Source
+	e.Chapters = info.Chapters
+	e.Tempo = info.Tempo
+	e.SilenceTrimmed = info.SilenceTrimmed
+	mi.dirty = true
+	mi.mu.Unlock()
+
+	return mi.Save()
+}
+
+// Find returns the path and ffprobe result of the file produced by the request identified by source,
+// if it is still in the library.
+func (mi *metadataIndex) Find(source string) (string, *ffprobe, bool) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	for filename, e := range mi.entries {
+		if e.Source != source {
+			continue
+		}
+		if _, err := os.Stat(filename); err != nil {
+			continue
+		}
+		return filename, e.Probe, true
+	}
+	return "", nil, false
+}
+
+// Owner returns the user that published the file at filename to the shared library.
+func (mi *metadataIndex) Owner(filename string) string {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if e, ok := mi.entries[filename]; ok {
+		return e.Owner
+	}
+	return ""
+}
+
+// Chapters returns the chapters of the file at filename.
+func (mi *metadataIndex) Chapters(filename string) []ytworker.Chapter {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if e, ok := mi.entries[filename]; ok {
+		return e.Chapters
+	}
+	return nil
+}
+
+// Processing returns the tempo the file at filename was rendered at, zero if unchanged, and whether
+// long silences were removed.
+func (mi *metadataIndex) Processing(filename string) (tempo float64, silenceTrimmed bool) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if e, ok := mi.entries[filename]; ok {
+		return e.Tempo, e.SilenceTrimmed
+	}
+	return 0, false
+}
+
+// ID returns the ID of the file at filename, assigning one if it has none yet.
+func (mi *metadataIndex) ID(filename string) string {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	e, ok := mi.entries[filename]
+	if !ok {
+		return ""
+	}
+	if e.ID == "" {
+		b := make([]byte, 8)
+		// crypto/rand Read never returns an error
+		_, _ = rand.Read(b)
+		e.ID = hex.EncodeToString(b)
+		mi.dirty = true
+	}
+	return e.ID
+}
+
+// ByID returns the path of the file with the given ID.
+func (mi *metadataIndex) ByID(id string) (string, bool) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	for filename, e := range mi.entries {
+		if e.ID == id && id != "" {
+			return filename, true
+		}
+	}
+	return "", false
+}
+
+// Position returns where the user with library dir stopped listening to the file at filename.
+func (mi *metadataIndex) Position(filename, dir string) (position, bool) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if e, ok := mi.entries[filename]; ok {
+		if p, ok := e.Positions[dir]; ok {
+			return *p, true
+		}
+	}
+	return position{}, false
+}
+
+// Positions returns where the user with library dir stopped listening, keyed by item ID.
+func (mi *metadataIndex) Positions(dir string) map[string]position {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	positions := make(map[string]position)
+	for _, e := range mi.entries {
+		if p, ok := e.Positions[dir]; ok && e.ID != "" {
+			positions[e.ID] = *p
+		}
+	}
+	return positions
+}
+
+// SetPosition records where the user with library dir stopped listening to the file at filename.
+// Like play times, it's saved with the next change to the index.
+func (mi *metadataIndex) SetPosition(filename, dir string, p position) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	e, ok := mi.entries[filename]
+	if !ok {
+		return fmt.Errorf("'%s' is not in the library", filepath.Base(filename))
+	}
+	if e.Positions == nil {
+		e.Positions = make(map[string]*position)
+	}
+	e.Positions[dir] = &p
+	mi.dirty = true
+	return nil
+}
+
+// Pin sets whether the file at filename is kept regardless of expiry and the library quota.
+func (mi *metadataIndex) Pin(filename string, pinned bool) error {
+	mi.mu.Lock()
+	e, ok := mi.entries[filename]
+	if ok && e.Pinned != pinned {
+		e.Pinned = pinned
+		mi.dirty = true
+	}
+	mi.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("'%s' is not in the library", filepath.Base(filename))
+	}
+
+	return mi.Save()
+}
+
+// Played records that the file at filename was fetched. It's saved with the next change to the index.
+func (mi *metadataIndex) Played(filename string) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if e, ok := mi.entries[filename]; ok {
+		e.Played = time.Now()
+		mi.dirty = true
+	}
+}
+
+// Usage returns whether the file at filename is pinned and when it was last played,
+// for deciding which files to remove first.
+func (mi *metadataIndex) Usage(filename string) (pinned bool, played time.Time) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if e, ok := mi.entries[filename]; ok {
+		return e.Pinned, e.Played
+	}
+	return false, time.Time{}
+}
+
+// Move updates the index for a file that was renamed from oldname to newname, setting its owner.
+// The entry no longer identifies a request's output, as it has left the library of the user that requested it.
+func (mi *metadataIndex) Move(oldname, newname, owner string) error {
+	mi.mu.Lock()
+	if e, ok := mi.entries[oldname]; ok {
+		delete(mi.entries, oldname)
+		e.Source = ""
+		e.Owner = owner
+		mi.entries[newname] = e
+		mi.dirty = true
+	}
+	mi.mu.Unlock()
+
+	return mi.Save()
+}
+
+// Prune removes entries for files in dir that are not in keep.
+func (mi *metadataIndex) Prune(dir string, keep map[string]bool) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	for filename := range mi.entries {
+		if filepath.Dir(filename) == dir && !keep[filename] {
+			delete(mi.entries, filename)
+			mi.dirty = true
+		}
+	}
+}
+
+// Save writes the index to disk if it has changed.
+func (mi *metadataIndex) Save() error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if !mi.dirty {
+		return nil
+	}
+
+	raw, err := json.Marshal(mi.entries)
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(mi.path, raw); err != nil {
+		return err
+	}
+	mi.dirty = false
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// maximum playback rate accepted, the highest browsers support
+const maxPlaybackRate = 16
+
+// positionRequest is the body of a position update. The time it was last played is set by the server.
+type positionRequest struct {
+	Position     float64
+	Duration     float64
+	PlaybackRate float64
+}
+
+// itemFile returns the path on disk of the item with the given ID and the library directory of user,
+// if user may see the item: it's in their own library or the shared library.
+func itemFile(id, webRoot, user string, libs *libraries, index *metadataIndex) (filename, dir string, ok bool) {
+	filename, ok = index.ByID(id)
+	if !ok {
+		return "", "", false
+	}
+	rel, err := filepath.Rel(webRoot, filename)
+	if err != nil {
+		return "", "", false
+	}
+	itemDir, ok := libs.libraryOf(filepath.ToSlash(rel))
+	dir = libs.Dir(user)
+	if !ok || (itemDir != dir && itemDir != sharedDir) || !fileExists(filename) {
+		return "", "", false
+	}
+	return filename, dir, true
+}
+
+// PositionsHandler returns where the requesting user stopped listening to each item, keyed by item ID.
+func PositionsHandler(libs *libraries, index *metadataIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		positions := index.Positions(libs.Dir(userFromContext(r.Context())))
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(positions); err != nil {
+			slog.Error("PositionsHandler response write error", "error", err)
+		}
+	}
+}
+
+// PositionHandler returns where the requesting user stopped listening to the item given by the {id} path value.
+func PositionHandler(webRoot string, libs *libraries, index *metadataIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filename, dir, ok := itemFile(r.PathValue("id"), webRoot, userFromContext(r.Context()), libs, index)
+		if !ok {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
+		p, ok := index.Position(filename, dir)
+		if !ok {
+			http.Error(w, "no position for item", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			slog.Error("PositionHandler response write error", "error", err)
+		}
+	}
+}
+
+// UpdatePositionHandler records where the requesting user stopped listening to the item given by the {id} path value.
+// Each user has their own position, so that they can resume on another device.
+func UpdatePositionHandler(webRoot string, libs *libraries, index *metadataIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filename, dir, ok := itemFile(r.PathValue("id"), webRoot, userFromContext(r.Context()), libs, index)
+		if !ok {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
+
+		var req positionRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "JSON decode error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Position < 0 || req.Duration < 0 || req.PlaybackRate < 0 || req.PlaybackRate > maxPlaybackRate {
+			http.Error(w, "position, duration or playback rate out of range", http.StatusBadRequest)
+			return
+		}
+		if req.PlaybackRate == 0 {
+			req.PlaybackRate = 1
+		}
+
+		p := position{
+			Position:     req.Position,
+			Duration:     req.Duration,
+			PlaybackRate: req.PlaybackRate,
+			LastPlayed:   time.Now(),
+		}
+		if err := index.SetPosition(filename, dir, p); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
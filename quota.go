@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/metrics"
+	"github.com/porjo/ytdl-web/internal/ytworker"
+)
+
+// quota keeps the total size of the libraries within a budget. When a download needs room,
+// the least recently used files are evicted first: those played or downloaded longest ago.
+// Pinned files are never evicted.
+type quota struct {
+	limit int64
+	// output path on disk
+	outPath string
+	index   *metadataIndex
+
+	mu sync.Mutex
+	// bytes reserved by running downloads, by job ID
+	reserved map[int64]int64
+}
+
+// libraryFile is a file in one of the libraries, as considered for eviction.
+type libraryFile struct {
+	path    string
+	size    int64
+	lastUse time.Time
+	pinned  bool
+}
+
+func newQuota(limit int64, outPath string, index *metadataIndex) *quota {
+	return &quota{
+		limit:    limit,
+		outPath:  outPath,
+		index:    index,
+		reserved: make(map[int64]int64),
+	}
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix, e.g. '20G'.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	shift := 0
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", s[i]) + 1)
+		s = s[:i]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	return int64(n * float64(int64(1)<<shift)), nil
+}
+
+// Available returns the most room a download could have, if every file that isn't pinned was evicted.
+func (q *quota) Available() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := q.files()
+	if err != nil {
+		slog.Error("library scan error", "error", err)
+		return 0
+	}
+	avail := q.limit - q.reservedBytes(0)
+	for _, f := range files {
+		if f.pinned {
+			avail -= f.size
+		}
+	}
+	return avail
+}
+
+// Reserve makes room for a download of size bytes by the job id, evicting files if needed.
+// The room is held until [quota.Release] is called. It returns an error wrapping
+// [ytworker.ErrNoSpace] if evicting every file that isn't pinned wouldn't be enough.
+func (q *quota) Reserve(id, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.evict(size + q.reservedBytes(id)); err != nil {
+		return err
+	}
+	q.reserved[id] = size
+	return nil
+}
+
+// Release frees the room reserved for the job id, once its file is in the library or it has failed.
+func (q *quota) Release(id int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.reserved, id)
+}
+
+// Enforce evicts files until the libraries are within the quota, e.g. when downloads turned out
+// bigger than their reservation.
+func (q *quota) Enforce() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.evict(q.reservedBytes(0)); err != nil {
+		slog.Warn("library over quota", "error", err)
+	}
+}
+
+// evict removes the least recently used files that aren't pinned until the libraries have
+// room for extra bytes. Must be called with mu held.
+func (q *quota) evict(extra int64) error {
+	files, err := q.files()
+	if err != nil {
+		return err
+	}
+
+	used := extra
+	for _, f := range files {
+		used += f.size
+	}
+	if used <= q.limit {
+		return nil
+	}
+
+	// check there is enough to evict before removing anything
+	evictable := int64(0)
+	for _, f := range files {
+		if !f.pinned {
+			evictable += f.size
+		}
+	}
+	if used-evictable > q.limit {
+		return fmt.Errorf("%w: need %d bytes, the quota is %d bytes and pinned files use %d",
+			ytworker.ErrNoSpace, extra, q.limit, used-extra-evictable)
+	}
+
+	slices.SortFunc(files, func(a, b libraryFile) int {
+		return a.lastUse.Compare(b.lastUse)
+	})
+	for _, f := range files {
+		if used <= q.limit {
+			break
+		}
+		if f.pinned {
+			continue
+		}
+		if err := removeItem(f.path); err != nil {
+			return err
+		}
+		used -= f.size
+		metrics.QuotaEvictedFiles.Inc()
+		slog.Info("file evicted to stay within quota", "file", f.path, "size", f.size)
+	}
+	return nil
+}
+
+// reservedBytes returns the room reserved by running downloads other than the job id.
+// Must be called with mu held.
+func (q *quota) reservedBytes(except int64) int64 {
+	var n int64
+	for id, size := range q.reserved {
+		if id != except {
+			n += size
+		}
+	}
+	return n
+}
+
+// files lists the files in the libraries, skipping the temporary directory and hidden files.
+// The size of a file includes its cover art and transcript.
+func (q *quota) files() ([]libraryFile, error) {
+	var files []libraryFile
+	err := filepath.WalkDir(q.outPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == filepath.Join(q.outPath, ytworker.TmpDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := libraryFile{path: path, size: fi.Size(), lastUse: fi.ModTime()}
+		// cover art and transcripts go with their item
+		for _, sidecar := range ytworker.SidecarFiles(path) {
+			if sfi, err := os.Stat(sidecar); err == nil {
+				f.size += sfi.Size()
+			}
+		}
+		var played time.Time
+		f.pinned, played = q.index.Usage(path)
+		if played.After(f.lastUse) {
+			f.lastUse = played
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// trackPlays records when files in the output path are fetched, so that the files evicted first
+// are those not played for the longest time.
+func trackPlays(webRoot, outPath string, index *metadataIndex, next http.Handler) http.Handler {
+	prefix := "/" + strings.Trim(outPath, "/") + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := path.Clean("/" + r.URL.Path); r.Method == http.MethodGet && strings.HasPrefix(p, prefix) {
+			index.Played(filepath.Join(webRoot, filepath.FromSlash(p)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
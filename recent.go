@@ -3,34 +3,83 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/porjo/ytdl-web/internal/metrics"
+	"github.com/porjo/ytdl-web/internal/util"
+	"github.com/porjo/ytdl-web/internal/ytworker"
+	sse "github.com/tmaxmax/go-sse"
 )
 
 const cleanupInterval = 30 * time.Second
 
 type recent struct {
+	// ID identifies the item in the API, e.g. for its listening position
+	ID     string
 	URL    string
 	Title  string
 	Artist string
 	//Description string
 	Timestamp time.Time
+	Size      int64
+	Video     bool
+	// Shared items are in the shared library, published by Owner
+	Shared bool
+	Owner  string `json:",omitempty"`
+	// Pinned items are never expired or evicted
+	Pinned bool
+	// Chapters are also served in Podcasting 2.0 format at URL + '.chapters.json'
+	Chapters []ytworker.Chapter `json:",omitempty"`
+	// Artwork is the URL of the item's cover art, a JPEG
+	Artwork string `json:",omitempty"`
+	// Transcript is the URL of the item's subtitles in WebVTT format. They are also served as
+	// plain text at URL + '.transcript.txt'.
+	Transcript string `json:",omitempty"`
+	// Duration in seconds, after any post-processing
+	Duration float64 `json:",omitempty"`
+	// Tempo the item was rendered at, zero if unchanged
+	Tempo float64 `json:",omitempty"`
+	// SilenceTrimmed is set if long silences were removed
+	SilenceTrimmed bool `json:",omitempty"`
+	// Position is where the library's user stopped listening. The shared library is sent to
+	// everyone, so its items have none: fetch them from /positions instead.
+	Position *position `json:",omitempty"`
 }
 
-func GetRecentURLs(ctx context.Context, webRoot, outPath string, ffProbeCmd string) ([]recent, error) {
+// GetRecentURLs lists the files in the library dir along with their metadata.
+// Metadata is read from the index, which only runs ffprobe on new or changed files.
+func GetRecentURLs(ctx context.Context, webRoot string, libs *libraries, dir string, index *metadataIndex) ([]recent, error) {
 	recentURLs := make([]recent, 0)
 
-	files, err := os.ReadDir(filepath.Join(webRoot, outPath))
+	libPath := libs.fullPath(webRoot, dir)
+	files, err := os.ReadDir(libPath)
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// nothing downloaded yet
+			return recentURLs, nil
+		}
 		return nil, err
 	}
 
+	seen := make(map[string]bool)
 	for _, file := range files {
-		if !file.IsDir() && file.Name() != ".README" && !strings.HasSuffix(file.Name(), ".json") {
-			ff, err := runFFprobe(ctx, ffProbeCmd, filepath.Join(webRoot, outPath, file.Name()))
+		// skip hidden files such as the job journal and metadata index
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") && !strings.HasSuffix(file.Name(), ".json") {
+			filename := filepath.Join(libPath, file.Name())
+			seen[filename] = true
+			i, err := file.Info()
+			if err != nil {
+				slog.Info(err.Error())
+				continue
+			}
+			ff, err := index.Get(ctx, filename, i)
 			if err != nil {
 				if errors.Is(err, context.DeadlineExceeded) {
 					slog.Error("ffprobe ran too long and was cancelled", "error", err)
@@ -41,52 +90,229 @@ func GetRecentURLs(ctx context.Context, webRoot, outPath string, ffProbeCmd stri
 				continue
 			}
 			r := recent{}
-			r.URL = filepath.Join(outPath, file.Name())
+			r.ID = index.ID(filename)
+			r.URL = path.Join(libs.outPath, dir, file.Name())
 			//r.Title, r.Artist, r.Description = titleArtistDescription(ff)
 			r.Title, r.Artist, _ = titleArtistDescription(ff)
-			i, err := file.Info()
-			if err != nil {
-				slog.Info(err.Error())
-				continue
-			}
 			r.Timestamp = i.ModTime()
+			r.Size = i.Size()
+			r.Video = hasVideo(ff)
+			r.Duration = duration(ff)
+			r.Tempo, r.SilenceTrimmed = index.Processing(filename)
+			if dir == sharedDir {
+				r.Shared = true
+				r.Owner = index.Owner(filename)
+			} else if p, ok := index.Position(filename, dir); ok {
+				r.Position = &p
+			}
+			r.Pinned, _ = index.Usage(filename)
+			r.Chapters = index.Chapters(filename)
+			if artwork := ytworker.ArtworkFile(filename); fileExists(artwork) {
+				r.Artwork = path.Join(libs.outPath, dir, filepath.Base(artwork))
+			}
+			if transcript := ytworker.TranscriptFile(filename); fileExists(transcript) {
+				r.Transcript = path.Join(libs.outPath, dir, filepath.Base(transcript))
+			}
 			recentURLs = append(recentURLs, r)
 		}
 	}
 
+	index.Prune(libPath, seen)
+	if err := index.Save(); err != nil {
+		slog.Error("metadata index save error", "error", err)
+	}
+
 	return recentURLs, nil
 }
 
-func DeleteFiles(urls []string, webRoot string) error {
+// publishRecent sends the list of items in library dir to the clients of that library.
+// The shared library is sent to every client.
+func publishRecent(ctx context.Context, s *sse.Server, webRoot string, libs *libraries, dir string, index *metadataIndex) error {
+	recentURLs, err := GetRecentURLs(ctx, webRoot, libs, dir, index)
+	if err != nil {
+		return err
+	}
+
+	m := util.Msg{Key: "recent", Value: recentURLs}
+	topic := libs.Topic(dir)
+	if dir == sharedDir {
+		m.Key = "shared"
+		topic = sse.DefaultTopic
+	}
+	j, _ := m.JSON()
+	slog.Debug("recent", "library", dir, "url_count", len(recentURLs))
+	sseM := &sse.Message{}
+	sseM.AppendData(string(j))
+	return s.Publish(sseM, topic)
+}
+
+// ownFile returns the path on disk of the file at url, relative to the web root, if user may
+// change it: it's in their own library, or they published it to the shared library.
+func ownFile(u, webRoot, user string, libs *libraries, index *metadataIndex) (string, error) {
+	dir, ok := libs.libraryOf(u)
+	if !ok {
+		return "", fmt.Errorf("'%s' is not in a library", u)
+	}
+	path := filepath.Join(webRoot, filepath.FromSlash(u))
+	if dir == sharedDir {
+		if index.Owner(path) != user {
+			return "", fmt.Errorf("'%s' was shared by another user", u)
+		}
+	} else if dir != libs.Dir(user) {
+		return "", fmt.Errorf("'%s' is not in your library", u)
+	}
+	return path, nil
+}
+
+// removeItem removes the library item at filename along with its cover art and transcript.
+func removeItem(filename string) error {
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	for _, f := range ytworker.SidecarFiles(filename) {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// orphanedSidecar reports whether the file at filename is the cover art or transcript of an item
+// that no longer exists.
+func orphanedSidecar(filename string) bool {
+	name := filepath.Base(filename)
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, ext := range []string{ytworker.ArtworkExt, ytworker.TranscriptExt} {
+		if item, ok := strings.CutSuffix(name[1:], ext); ok {
+			return !fileExists(filepath.Join(filepath.Dir(filename), item))
+		}
+	}
+	return false
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// DeleteFiles removes the files at urls, relative to the web root. Users can only delete
+// files in their own library, and files they published to the shared library.
+func DeleteFiles(urls []string, webRoot, user string, libs *libraries, index *metadataIndex) error {
 
 	for _, u := range urls {
-		path := filepath.Join(webRoot, u)
-		if err := os.Remove(path); err != nil {
+		path, err := ownFile(u, webRoot, user, libs, index)
+		if err != nil {
+			return err
+		}
+		if err := removeItem(path); err != nil {
 			return err
 		}
-		slog.Info("file removed", "file", path)
+		slog.Info("file removed", "file", path, "user", user)
 	}
 	return nil
 }
 
-func fileCleanup(outPath string, expiry time.Duration) {
+// PinFiles sets whether the files at urls are kept regardless of expiry and the library quota.
+// Users can pin the same files they can delete.
+func PinFiles(urls []string, pinned bool, webRoot, user string, libs *libraries, index *metadataIndex) error {
+	for _, u := range urls {
+		path, err := ownFile(u, webRoot, user, libs, index)
+		if err != nil {
+			return err
+		}
+		if err := index.Pin(path, pinned); err != nil {
+			return err
+		}
+		slog.Info("file pinned", "file", path, "pinned", pinned, "user", user)
+	}
+	return nil
+}
+
+// PublishFiles moves the files at urls from the user's library to the shared library.
+func PublishFiles(urls []string, webRoot, user string, libs *libraries, index *metadataIndex) error {
+	if !libs.shared {
+		return fmt.Errorf("the shared library is not enabled")
+	}
+
+	sharedPath := libs.fullPath(webRoot, sharedDir)
+	if err := os.MkdirAll(sharedPath, os.ModePerm); err != nil {
+		return err
+	}
+	for _, u := range urls {
+		if dir, ok := libs.libraryOf(u); !ok || dir != libs.Dir(user) {
+			return fmt.Errorf("'%s' is not in your library", u)
+		}
+		src := filepath.Join(webRoot, filepath.FromSlash(u))
+		dst := filepath.Join(sharedPath, filepath.Base(src))
+		if _, err := os.Stat(dst); err == nil {
+			return fmt.Errorf("'%s' is already shared", filepath.Base(src))
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+		srcSidecars := ytworker.SidecarFiles(src)
+		for i, dstSidecar := range ytworker.SidecarFiles(dst) {
+			if err := os.Rename(srcSidecars[i], dstSidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("file move error", "file", srcSidecars[i], "error", err)
+			}
+		}
+		if err := index.Move(src, dst, user); err != nil {
+			slog.Error("metadata index save error", "error", err)
+		}
+		slog.Info("file shared", "file", dst, "user", user)
+	}
+	return nil
+}
+
+// fileCleanup periodically removes files older than the expiry of their library from outPath,
+// which is the output path on disk, except pinned files. If there is a quota, it evicts files
+// until the libraries are within it.
+func fileCleanup(outPath string, libs *libraries, index *metadataIndex, q *quota) {
+	var libraryBytes int64
 	visit := func(path string, f os.FileInfo, err error) error {
 
 		if err != nil {
 			return err
 		}
 
-		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+		if f.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(f.Name(), ".") {
+			// cover art and transcripts are removed with their item, unless it was removed some other way
+			if orphanedSidecar(path) {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				slog.Info("orphaned file removed", "file", path)
+			}
 			return nil
 		}
 
+		dir, err := filepath.Rel(outPath, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		dir = filepath.ToSlash(dir)
+		if dir == "." {
+			dir = ""
+		}
+
+		pinned, _ := index.Usage(path)
+
 		// if last modification time is prior to expiry time,
 		// then delete the file
-		if time.Since(f.ModTime()) > expiry {
-			if err := os.Remove(path); err != nil {
+		if !pinned && time.Since(f.ModTime()) > libs.Expiry(dir) {
+			if err := removeItem(path); err != nil {
 				return err
 			}
+			metrics.CleanupRemovedFiles.Inc()
 			slog.Info("old file removed", "file", path)
+		} else if dir != ytworker.TmpDir {
+			// files in the temporary directory are still being downloaded
+			libraryBytes += f.Size()
 		}
 		return nil
 	}
@@ -94,9 +320,20 @@ func fileCleanup(outPath string, expiry time.Duration) {
 	tickChan := time.NewTicker(cleanupInterval)
 
 	for range tickChan.C {
+		if q != nil {
+			q.Enforce()
+		}
+		// keep the play times recorded since the last save
+		if err := index.Save(); err != nil {
+			slog.Error("metadata index save error", "error", err)
+		}
+
+		libraryBytes = 0
 		err := filepath.Walk(outPath, visit)
 		if err != nil {
 			slog.Error("file cleanup error", "error", err)
+			continue
 		}
+		metrics.LibraryBytes.Set(float64(libraryBytes))
 	}
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/porjo/ytdl-web/internal/jobs"
+	"github.com/porjo/ytdl-web/internal/util"
+	"github.com/porjo/ytdl-web/internal/ytworker"
+	sse "github.com/tmaxmax/go-sse"
+)
+
+// replayMessage is a message held for replay, with the sequence number of its ID.
+type replayMessage struct {
+	seq uint64
+	msg *sse.Message
+}
+
+// replayTopic holds the latest messages published to an SSE topic.
+type replayTopic struct {
+	messages []replayMessage
+	// sequence number of the newest message that no longer fits in the buffer
+	dropped uint64
+	updated time.Time
+}
+
+// topicReplayer is an [sse.Replayer] that keeps the latest messages of each topic, so a busy session
+// can't push the messages of other sessions out of the buffer.
+//
+// Message IDs are '<epoch>-<seq>' where epoch is unique to the process, so IDs from before a restart
+// are recognised as unknown.
+//
+// Clients that connect without a known ID, or whose ID is older than the buffered messages,
+// are sent a snapshot of the current state.
+type topicReplayer struct {
+	mu sync.Mutex
+
+	epoch  string
+	seq    uint64
+	size   int
+	expiry time.Duration
+	lastGC time.Time
+	topics map[string]*replayTopic
+
+	// snapshot returns messages describing the current state of the topics
+	snapshot func(topics []string) []*sse.Message
+}
+
+// newTopicReplayer returns a replayer that keeps up to size messages per topic.
+// Topics without new messages for expiry are forgotten.
+func newTopicReplayer(size int, expiry time.Duration, snapshot func(topics []string) []*sse.Message) *topicReplayer {
+	return &topicReplayer{
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:     size,
+		expiry:   expiry,
+		lastGC:   time.Now(),
+		topics:   make(map[string]*replayTopic),
+		snapshot: snapshot,
+	}
+}
+
+// Put assigns the message an ID and buffers it for each of its topics.
+// Messages with an event type, i.e. pings, are passed through without an ID.
+func (tr *topicReplayer) Put(m *sse.Message, topics []string) (*sse.Message, error) {
+	if len(topics) == 0 {
+		return nil, sse.ErrNoTopic
+	}
+	if m.Type.IsSet() {
+		return m, nil
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.seq++
+	m = m.Clone()
+	m.ID = sse.ID(tr.epoch + "-" + strconv.FormatUint(tr.seq, 10))
+
+	now := time.Now()
+	for _, topic := range topics {
+		rt, ok := tr.topics[topic]
+		if !ok {
+			rt = &replayTopic{}
+			tr.topics[topic] = rt
+		}
+		rt.messages = append(rt.messages, replayMessage{seq: tr.seq, msg: m})
+		if len(rt.messages) > tr.size {
+			rt.dropped = rt.messages[0].seq
+			rt.messages = slices.Delete(rt.messages, 0, 1)
+		}
+		rt.updated = now
+	}
+
+	// forget sessions that have gone quiet
+	if now.Sub(tr.lastGC) > tr.expiry {
+		tr.lastGC = now
+		for topic, rt := range tr.topics {
+			if topic != sse.DefaultTopic && now.Sub(rt.updated) > tr.expiry {
+				delete(tr.topics, topic)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// Replay sends the subscriber the messages of its topics published after its last event ID,
+// followed by a snapshot if messages may have been missed.
+func (tr *topicReplayer) Replay(sub sse.Subscription) error {
+	last, known := tr.parseID(sub.LastEventID)
+
+	tr.mu.Lock()
+	var messages []replayMessage
+	gap := !known
+	if known {
+		for _, topic := range sub.Topics {
+			rt, ok := tr.topics[topic]
+			if !ok {
+				continue
+			}
+			if rt.dropped > last {
+				gap = true
+			}
+			for _, rm := range rt.messages {
+				if rm.seq > last {
+					messages = append(messages, rm)
+				}
+			}
+		}
+	}
+	tr.mu.Unlock()
+
+	// a message published to several topics is only sent once
+	slices.SortFunc(messages, func(a, b replayMessage) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	messages = slices.CompactFunc(messages, func(a, b replayMessage) bool {
+		return a.seq == b.seq
+	})
+
+	sent := false
+	for _, rm := range messages {
+		if err := sub.Client.Send(rm.msg); err != nil {
+			return err
+		}
+		sent = true
+	}
+	if gap && tr.snapshot != nil {
+		for _, m := range tr.snapshot(sub.Topics) {
+			if err := sub.Client.Send(m); err != nil {
+				return err
+			}
+			sent = true
+		}
+	}
+
+	if !sent {
+		return nil
+	}
+	return sub.Client.Flush()
+}
+
+// parseID returns the sequence number of id, and false if it wasn't issued by this process.
+func (tr *topicReplayer) parseID(id sse.EventID) (uint64, bool) {
+	if !id.IsSet() {
+		return 0, false
+	}
+	epoch, seq, ok := strings.Cut(id.String(), "-")
+	if !ok || epoch != tr.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// lastEventIDParam passes the lastEventId query parameter on as the Last-Event-ID header.
+// EventSource only sends the header when it reconnects by itself, not when the page
+// opens a new connection after an error.
+func lastEventIDParam(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.URL.Query().Get("lastEventId"); id != "" && r.Header.Get("Last-Event-ID") == "" {
+			r.Header.Set("Last-Event-ID", id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jobSnapshot returns messages describing the active jobs of the sessions among topics,
+// in the same form as the worker reports them.
+func jobSnapshot(journal *jobs.Journal, topics []string) []*sse.Message {
+	var msgs []util.Msg
+	for _, session := range topics {
+		if session == sse.DefaultTopic {
+			continue
+		}
+		for _, r := range journal.Records(session) {
+			if r.State.Finished() {
+				continue
+			}
+			if r.State == jobs.StateQueued || r.Title == "" {
+				msgs = append(msgs, util.Msg{Key: ytworker.KeyQueued, Value: ytworker.Misc{Id: r.ID, Msg: r.URL}})
+			} else {
+				info := ytworker.Info{
+					Id:       r.ID,
+					Title:    r.Title,
+					Video:    r.Options.Mode == ytworker.ModeVideo,
+					Progress: ytworker.Progress{Pct: r.Progress, ETA: r.ETA},
+				}
+				msgs = append(msgs, util.Msg{Key: ytworker.KeyInfo, Value: info})
+			}
+		}
+	}
+
+	sseMsgs := make([]*sse.Message, 0, len(msgs))
+	for _, m := range msgs {
+		j, err := m.JSON()
+		if err != nil {
+			continue
+		}
+		sseM := &sse.Message{}
+		sseM.AppendData(string(j))
+		sseMsgs = append(sseMsgs, sseM)
+	}
+	return sseMsgs
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// name of the cookie that ties a browser's SSE connection to the jobs it submits
+const sessionCookieName = "ytdl_session"
+
+// sessionID returns the session ID from the request cookie. If the client doesn't have one yet,
+// a new ID is generated and set on the response.
+//
+// The session ID doubles as the SSE topic the client is subscribed to, so job messages
+// are only delivered to the browser that submitted the job.
+func sessionID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(sessionCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	id := newSessionID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	// crypto/rand Read never returns an error
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
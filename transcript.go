@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/porjo/ytdl-web/internal/ytworker"
+)
+
+// suffix appended to an item's URL for its plain text transcript
+const transcriptSuffix = ".transcript.txt"
+
+var (
+	// WebVTT cue timings e.g. '00:01:02.500 --> 00:01:05.000 align:start position:0%'
+	vttTimingRe = regexp.MustCompile(`^(\d+:)?\d{2}:\d{2}\.\d{3} --> `)
+	// inline tags such as <c>, <i> and timestamps like <00:00:01.000>
+	vttTagRe = regexp.MustCompile(`<[^>]*>`)
+)
+
+func init() {
+	// not in Go's built in table, and not in every system's mime.types
+	if err := mime.AddExtensionType(ytworker.TranscriptExt, "text/vtt; charset=utf-8"); err != nil {
+		slog.Error("mime type error", "error", err)
+	}
+}
+
+// serveTranscript serves the transcript of an item in the output path as plain text at the item's URL
+// with '.transcript.txt' appended. Other requests are passed to next.
+func serveTranscript(webRoot, outPath string, next http.Handler) http.Handler {
+	prefix := "/" + strings.Trim(outPath, "/") + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		item, ok := strings.CutSuffix(p, transcriptSuffix)
+		if !ok || r.Method != http.MethodGet || !strings.HasPrefix(p, prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := os.Open(ytworker.TranscriptFile(filepath.Join(webRoot, filepath.FromSlash(item))))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := vttText(w, f); err != nil {
+			slog.Error("transcript write error", "error", err)
+		}
+	})
+}
+
+// vttText writes the text of the WebVTT cues read from r, one line each, without timings or markup.
+// Generated subtitles repeat each line in the next cue as they roll up, so repeated lines are dropped.
+func vttText(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	inCue := false
+	last := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			// a blank line ends the header, a cue or a note
+			inCue = false
+			continue
+		case vttTimingRe.MatchString(line):
+			inCue = true
+			continue
+		case !inCue:
+			// the header, cue identifiers, NOTE and STYLE blocks
+			continue
+		}
+
+		text := strings.TrimSpace(html.UnescapeString(vttTagRe.ReplaceAllString(line, "")))
+		if text == "" || text == last {
+			continue
+		}
+		last = text
+		if _, err := bw.WriteString(text + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}